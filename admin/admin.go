@@ -0,0 +1,187 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"registrator-containerd/bridge"
+	"registrator-containerd/utils"
+	"sort"
+)
+
+var logger = utils.L.WithField("component", "admin")
+
+// Server exposes the state of a running bridge over HTTP and allows
+// operators to trigger a resync, a cleanup or the re-registration of
+// a single container.
+type Server struct {
+	bridge *bridge.Bridge
+	mux    *http.ServeMux
+}
+
+func New(b *bridge.Bridge) *Server {
+	s := &Server{bridge: b, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/services", s.handleServices)
+	s.mux.HandleFunc("/dead", s.handleDead)
+	s.mux.HandleFunc("/sync", s.handleSync)
+	s.mux.HandleFunc("/cleanup", s.handleCleanup)
+	s.mux.HandleFunc("/reregister", s.handleReregister)
+	s.mux.HandleFunc("/healthz", s.handleHealthz)
+	s.mux.HandleFunc("/readyz", s.handleReadyz)
+	return s
+}
+
+// Handle registers an additional handler on the admin server.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	logger.WithField("addr", addr).Info("admin API listening")
+	return http.ListenAndServe(addr, s)
+}
+
+// ContainerServices 容器及其已注册的服务
+type ContainerServices struct {
+	ContainerID string
+	Services    []*bridge.Service
+}
+
+// DeadContainer 已退出但仍在TTL内保留的容器
+type DeadContainer struct {
+	ContainerID string
+	TTL         int
+	Services    []*bridge.Service
+}
+
+// CheckResult 健康检查结果
+type CheckResult struct {
+	Status string
+	Checks map[string]string
+}
+
+func (s *Server) handleServices(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	services := s.bridge.Services()
+	out := make([]ContainerServices, 0, len(services))
+	for containerId, list := range services {
+		out = append(out, ContainerServices{ContainerID: containerId, Services: bridge.RedactServices(list)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ContainerID < out[j].ContainerID })
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) handleDead(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	deadContainers := s.bridge.DeadContainers()
+	out := make([]DeadContainer, 0, len(deadContainers))
+	for containerId, d := range deadContainers {
+		out = append(out, DeadContainer{ContainerID: containerId, TTL: d.TTL, Services: bridge.RedactServices(d.Services)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ContainerID < out[j].ContainerID })
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) handleSync(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	logger.Info("sync requested")
+	s.bridge.Sync(true)
+	writeJSON(w, http.StatusOK, map[string]any{"LastSync": s.bridge.LastSync()})
+}
+
+func (s *Server) handleCleanup(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	logger.Info("cleanup requested")
+	if err := s.bridge.Cleanup(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"Status": "ok"})
+}
+
+func (s *Server) handleReregister(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	containerId := r.URL.Query().Get("container")
+	if containerId == "" {
+		writeError(w, http.StatusBadRequest, "missing container parameter")
+		return
+	}
+	logger.WithField("container", containerId).Info("reregister requested")
+	writeJSON(w, http.StatusOK, ContainerServices{
+		ContainerID: containerId,
+		Services:    bridge.RedactServices(s.bridge.Reregister(containerId)),
+	})
+}
+
+// handleHealthz reports whether registrator can still talk to containerd.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	result := CheckResult{Status: "ok", Checks: make(map[string]string)}
+	check(&result, "containerd", s.bridge.CheckRuntime())
+	writeCheck(w, result)
+}
+
+// handleReadyz additionally requires the registry backend to be reachable
+// and the initial sync to have completed.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	result := CheckResult{Status: "ok", Checks: make(map[string]string)}
+	check(&result, "containerd", s.bridge.CheckRuntime())
+	check(&result, "registry", s.bridge.CheckRegistry())
+	if s.bridge.LastSync().IsZero() {
+		result.Status = "fail"
+		result.Checks["sync"] = "initial sync not completed"
+	} else {
+		result.Checks["sync"] = "ok"
+	}
+	writeCheck(w, result)
+}
+
+func check(result *CheckResult, name string, err error) {
+	if err != nil {
+		result.Status = "fail"
+		result.Checks[name] = err.Error()
+		return
+	}
+	result.Checks[name] = "ok"
+}
+
+func writeCheck(w http.ResponseWriter, result CheckResult) {
+	status := http.StatusOK
+	if result.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, result)
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"Error": message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.WithError(err).Warn("write response failed")
+	}
+}
@@ -0,0 +1,130 @@
+package bridge
+
+import (
+	"context"
+	"net/url"
+	"time"
+)
+
+// legacyAdapter runs a RegistryAdapter behind the context-aware interface.
+// The calls cannot be cancelled, they are only skipped when the context is
+// done before they start. Updates are registrations.
+type legacyAdapter struct {
+	adapter RegistryAdapter
+}
+
+// NewLegacyAdapter wraps an adapter that does not take a context.
+func NewLegacyAdapter(adapter RegistryAdapter) RegistryAdapterV2 {
+	if v1, ok := adapter.(*v1Adapter); ok {
+		return v1.adapter
+	}
+	return &legacyAdapter{adapter: adapter}
+}
+
+// Capabilities are the ones of the wrapped adapter, it cannot support
+// maintenance or a status.
+func (l *legacyAdapter) Capabilities() Capabilities {
+	if c, ok := l.adapter.(CapabilitiesAdapter); ok {
+		return c.Capabilities()
+	}
+	return Capabilities{TTL: true}
+}
+
+func (l *legacyAdapter) RegisterAgentNode(ctx context.Context, agent Agent) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return l.adapter.RegisterAgentNode(agent.DataCenterId, agent.HostIp)
+}
+
+func (l *legacyAdapter) Ping(ctx context.Context, agentId string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return l.adapter.Ping(agentId)
+}
+
+func (l *legacyAdapter) Register(ctx context.Context, service *Service) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return l.adapter.Register(service)
+}
+
+func (l *legacyAdapter) Update(ctx context.Context, service *Service) error {
+	return l.Register(ctx, service)
+}
+
+func (l *legacyAdapter) Deregister(ctx context.Context, service *Service) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return l.adapter.Deregister(service)
+}
+
+func (l *legacyAdapter) Refresh(ctx context.Context, service *Service) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return l.adapter.Refresh(service)
+}
+
+func (l *legacyAdapter) Services(ctx context.Context, agentId string) ([]*Service, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return l.adapter.Services(agentId)
+}
+
+// v1Adapter serves a context-aware adapter to callers of the RegistryAdapter
+// interface, without a deadline.
+type v1Adapter struct {
+	adapter RegistryAdapterV2
+}
+
+// AdapterV1 returns the RegistryAdapter of a context-aware adapter, for the
+// New method of an AdapterFactoryV2.
+func AdapterV1(adapter RegistryAdapterV2) RegistryAdapter {
+	return &v1Adapter{adapter: adapter}
+}
+
+func (v *v1Adapter) RegisterAgentNode(dataCenterId string, hostIp string) (string, error) {
+	return v.adapter.RegisterAgentNode(context.Background(), Agent{DataCenterId: dataCenterId, HostIp: hostIp})
+}
+
+func (v *v1Adapter) Ping(agentId string) error {
+	return v.adapter.Ping(context.Background(), agentId)
+}
+
+func (v *v1Adapter) Register(service *Service) error {
+	return v.adapter.Register(context.Background(), service)
+}
+
+func (v *v1Adapter) Deregister(service *Service) error {
+	return v.adapter.Deregister(context.Background(), service)
+}
+
+func (v *v1Adapter) Refresh(service *Service) error {
+	return v.adapter.Refresh(context.Background(), service)
+}
+
+func (v *v1Adapter) Services(agentId string) ([]*Service, error) {
+	return v.adapter.Services(context.Background(), agentId)
+}
+
+// newAdapter returns the context-aware adapter of a factory.
+func newAdapter(factory AdapterFactory, uri *url.URL) RegistryAdapterV2 {
+	if v2, ok := factory.(AdapterFactoryV2); ok {
+		return v2.NewV2(uri)
+	}
+	return NewLegacyAdapter(factory.New(uri))
+}
+
+// opContext returns the context of a backend operation with the given
+// timeout in seconds.
+func (b *Bridge) opContext(timeout int) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(b.ctx)
+	}
+	return context.WithTimeout(b.ctx, time.Duration(timeout)*time.Second)
+}
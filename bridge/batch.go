@@ -0,0 +1,130 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"registrator-containerd/pkg/metrics"
+	"time"
+)
+
+// batchOp is a registration or deregistration waiting in a batch, done is
+// called with its result.
+type batchOp struct {
+	service *Service
+	done    func(err error)
+}
+
+// batch groups the registrations and deregistrations of a Sync or Reconcile
+// for adapters that support batch calls.
+type batch struct {
+	registers   []batchOp
+	deregisters []batchOp
+	started     time.Time
+}
+
+// beginBatch starts grouping operations if the adapter supports it. It must
+// be called with the lock held, endBatch sends what is left.
+func (b *Bridge) beginBatch() {
+	if b.caps.Batch && b.config.BatchSize > 1 {
+		b.batch = &batch{started: time.Now()}
+	}
+}
+
+// endBatch must be called with the lock held.
+func (b *Bridge) endBatch() {
+	if b.batch == nil {
+		return
+	}
+	b.flushBatch()
+	b.batch = nil
+}
+
+// registerThen registers a service, or adds it to the current batch, and
+// calls done with the result. It must be called with the lock held.
+func (b *Bridge) registerThen(service *Service, update bool, done func(err error)) {
+	if b.batch == nil {
+		if update {
+			done(b.update(service))
+		} else {
+			done(b.register(service))
+		}
+		return
+	}
+	b.batch.registers = append(b.batch.registers, batchOp{service: service, done: done})
+	b.maybeFlushBatch()
+}
+
+// deregisterThen deregisters a service, or adds it to the current batch,
+// and calls done with the result. It must be called with the lock held.
+func (b *Bridge) deregisterThen(service *Service, done func(err error)) {
+	if b.batch == nil {
+		done(b.deregister(service))
+		return
+	}
+	b.batch.deregisters = append(b.batch.deregisters, batchOp{service: service, done: done})
+	b.maybeFlushBatch()
+}
+
+func (b *Bridge) maybeFlushBatch() {
+	size := len(b.batch.registers) + len(b.batch.deregisters)
+	interval := time.Duration(b.config.BatchInterval) * time.Millisecond
+	if size >= b.config.BatchSize || time.Since(b.batch.started) >= interval {
+		b.flushBatch()
+	}
+}
+
+// flushBatch sends the deregistrations and then the registrations of the
+// current batch. It must be called with the lock held.
+func (b *Bridge) flushBatch() {
+	registers, deregisters := b.batch.registers, b.batch.deregisters
+	b.batch.registers, b.batch.deregisters = nil, nil
+	b.batch.started = time.Now()
+
+	adapter := b.registry.(BatchAdapter)
+	b.sendBatch("deregister", deregisters, adapter.DeregisterBatch, b.deregister)
+	b.sendBatch("register", registers, adapter.RegisterBatch, b.register)
+}
+
+// sendBatch sends operations in one call. While the circuit breaker is open
+// or operations are queued they are sent one by one, so that they are queued
+// in order.
+func (b *Bridge) sendBatch(op string, ops []batchOp, call func(context.Context, []*Service) error, single func(*Service) error) {
+	if len(ops) == 0 {
+		return
+	}
+	services := make([]*Service, len(ops))
+	for i, o := range ops {
+		services[i] = o.service
+	}
+
+	timeout := b.config.AdapterTimeout
+	var failed *BatchError
+	err := b.guard.batch(func() error {
+		ctx, cancel := b.opContext(timeout)
+		defer cancel()
+		start := time.Now()
+		err := call(ctx, services)
+		metrics.ObserveRegistry(b.scheme, op+"_batch", start, err)
+		if errors.As(err, &failed) {
+			// some services failed, the backend answered
+			return nil
+		}
+		return err
+	})
+	if errors.Is(err, ErrCircuitOpen) {
+		for _, o := range ops {
+			o.done(single(o.service))
+		}
+		return
+	}
+	for _, o := range ops {
+		switch {
+		case err != nil:
+			o.done(err)
+		case failed != nil:
+			o.done(failed.Errors[o.service.ID])
+		default:
+			o.done(nil)
+		}
+	}
+}
@@ -2,18 +2,18 @@ package bridge
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
-	"fmt"
-	"github.com/containerd/containerd"
-	"log"
 	"net/url"
 	"os"
 	"regexp"
 	"registrator-containerd/pkg/ctrclient"
+	"registrator-containerd/pkg/metrics"
+	"registrator-containerd/utils"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 var Hostname string
@@ -24,21 +24,46 @@ func init() {
 	Hostname, _ = os.Hostname()
 }
 
-var serviceIDPattern = regexp.MustCompile(`^(.+?):([a-zA-Z0-9][a-zA-Z0-9_.-]+):[0-9]+(?::udp)?$`)
+// serviceIDPattern matches <hostname>[:<namespace>]:<container name>:<port>[:udp][:<network>]
+var serviceIDPattern = regexp.MustCompile(`^([^:]+):(?:([^:]+):)?([a-zA-Z0-9][a-zA-Z0-9_.-]+):[0-9]+(?::udp)?(?::[a-zA-Z0-9_.-]+)?$`)
 
 type Bridge struct {
 	sync.Mutex
-	registry       RegistryAdapter
-	ctrClient      *containerd.Client
+	registry       RegistryAdapterV2
+	caps           Capabilities
+	guard          *guard
+	scheme         string
+	source         ContainerSource
 	services       map[string][]*Service
 	deadContainers map[string]*DeadContainer
-	containerList  map[string]*containerd.Container
 	ctx            context.Context
 	config         Config
 	agentId        string
+	lastSync       time.Time
+
+	readiness       ReadinessGate
+	readinessPolicy string
+	// unready maps the containers held back by the readiness gate to the
+	// UID of their pod
+	unready map[string]string
+	// warmups are the containers whose services are being probed before
+	// they are registered
+	warmups map[string]*warmup
+	// paused are the containers whose task is paused
+	paused map[string]bool
+	// oomWarnings clear the warning status after an OOM kill
+	oomWarnings map[string]*time.Timer
+	// flaps count the starts of containers by flapKey, flapKeys map the
+	// container IDs that are up to their key
+	flaps    map[string]*flapState
+	flapKeys map[string]string
+	// batch groups the operations of a Sync or Reconcile while it runs
+	batch *batch
+	// danglingSince is when cleanup first found a service dangling, by ID
+	danglingSince map[string]time.Time
 }
 
-func New(ctrClient *containerd.Client, adapterUri string, config Config, ctx context.Context) (*Bridge, error) {
+func New(source ContainerSource, adapterUri string, config Config, ctx context.Context) (*Bridge, error) {
 	uri, err := url.Parse(adapterUri)
 	if err != nil {
 		return nil, errors.New("bad adapter uri: " + adapterUri)
@@ -47,37 +72,203 @@ func New(ctrClient *containerd.Client, adapterUri string, config Config, ctx con
 	if !found {
 		return nil, errors.New("unrecognized adapter: " + adapterUri)
 	}
-	log.Println("Using", uri.Scheme, "adapter:", uri)
-	return &Bridge{
-		ctrClient:      ctrClient,
+	ctx = utils.WithLogger(ctx, utils.G(ctx).WithField("adapter", uri.Scheme))
+	utils.G(ctx).WithField("uri", uri.String()).Info("using adapter")
+	b := &Bridge{
+		source:         source,
 		config:         config,
-		registry:       factory.New(uri),
+		registry:       newAdapter(factory, uri),
+		guard:          newGuard(ctx, uri.Scheme, config),
+		scheme:         uri.Scheme,
 		services:       make(map[string][]*Service),
 		deadContainers: make(map[string]*DeadContainer),
+		unready:        make(map[string]string),
+		warmups:        make(map[string]*warmup),
+		paused:         make(map[string]bool),
+		oomWarnings:    make(map[string]*time.Timer),
+		flaps:          make(map[string]*flapState),
+		flapKeys:       make(map[string]string),
+		danglingSince:  make(map[string]time.Time),
 		ctx:            ctx,
-	}, nil
+	}
+	b.guard.dropped = b.dropped
+	b.caps = adapterCapabilities(b.registry)
+	utils.G(ctx).WithFields(utils.Fields{
+		"ttl":         b.caps.TTL,
+		"maintenance": b.caps.Maintenance,
+		"status":      b.caps.Status,
+		"batch":       b.caps.Batch,
+		"agent":       b.caps.Agent,
+	}).Info("adapter capabilities")
+	b.reportUnsupported(config)
+	return b, nil
 }
 
+// Ping checks the backend and registers the agent.
 func (b *Bridge) Ping() error {
-	err := b.registry.Ping(b.agentId)
-	if err != nil {
+	b.Lock()
+	defer b.Unlock()
+	timeout := b.config.AdapterTimeout
+	err := b.guard.call(func() error {
+		ctx, cancel := b.opContext(timeout)
+		defer cancel()
+		return b.registry.Ping(ctx, b.agentId)
+	})
+	// the agent is not registered yet
+	if err != nil && !errors.Is(err, ErrUnknownAgent) {
+		return err
+	}
+	return b.registerAgent()
+}
+
+// Heartbeat pings the backend with the agent ID, where the backend keeps a
+// record of the agent. When the backend no longer knows the agent, it is
+// registered again and so are the services, under the new agent ID.
+func (b *Bridge) Heartbeat() error {
+	if !b.caps.Agent {
+		return nil
+	}
+	b.Lock()
+	timeout := b.config.AdapterTimeout
+	agentId := b.agentId
+	b.Unlock()
+	err := b.guard.call(func() error {
+		ctx, cancel := b.opContext(timeout)
+		defer cancel()
+		return b.registry.Ping(ctx, agentId)
+	})
+	if !errors.Is(err, ErrUnknownAgent) {
 		return err
 	}
-	agentId, err := b.registry.RegisterAgentNode(b.config.DataCenterId, b.config.HostIp)
+
+	b.Lock()
+	defer b.Unlock()
+	if b.agentId != agentId {
+		// registered again in the meantime
+		return nil
+	}
+	utils.G(b.ctx).WithField("agent", agentId).Warn("agent is unknown to the backend, registering it again")
+	// registerAgent replaces the tracked services, these keep the lost ID to
+	// deregister their records under it
+	var old []*Service
+	for _, services := range b.services {
+		old = append(old, services...)
+	}
+	if err := b.registerAgent(); err != nil {
+		return err
+	}
+	metrics.AgentReregistrations.WithLabelValues(b.scheme).Inc()
+
+	b.beginBatch()
+	defer b.endBatch()
+	if agentId != "" && agentId != b.agentId {
+		for _, service := range old {
+			service := service
+			b.deregisterThen(service, func(err error) {
+				if err != nil {
+					b.serviceLog(service).WithError(err).Warn("deregister under the lost agent failed")
+				}
+			})
+		}
+	}
+	for _, services := range b.services {
+		for _, service := range services {
+			service := service
+			b.registerThen(service, false, func(err error) {
+				if err != nil {
+					b.serviceLog(service).WithError(err).Error("register failed")
+					return
+				}
+				b.serviceLog(service).Info("registered again")
+			})
+		}
+	}
+	return nil
+}
+
+// registerAgent registers the agent and moves the tracked services and the
+// services of exited containers to its ID. The services are replaced rather
+// than changed, since queued operations and the snapshots of the admin API
+// may still read them. It must be called with the lock held.
+func (b *Bridge) registerAgent() error {
+	agent := b.agent()
+	timeout := b.config.AdapterTimeout
+	var agentId string
+	err := b.guard.call(func() (err error) {
+		ctx, cancel := b.opContext(timeout)
+		defer cancel()
+		agentId, err = b.registry.RegisterAgentNode(ctx, agent)
+		return err
+	})
 	if err != nil {
 		return err
 	}
 	b.agentId = agentId
-
+	for _, services := range b.services {
+		for i, service := range services {
+			services[i] = withAgent(service, agentId)
+		}
+	}
+	for _, dead := range b.deadContainers {
+		for i, service := range dead.Services {
+			dead.Services[i] = withAgent(service, agentId)
+		}
+	}
+	utils.G(b.ctx).WithField("agent", agentId).Info("agent registered")
 	return nil
 }
 
+// agent describes the node, the runtime details are left out when the
+// runtime cannot be reached.
+func (b *Bridge) agent() Agent {
+	agent := Agent{
+		DataCenterId: b.config.DataCenterId,
+		HostIp:       b.config.HostIp,
+		Hostname:     Hostname,
+		Version:      b.config.Version,
+	}
+	runtime, err := b.source.Version(b.ctx)
+	if err != nil {
+		utils.G(b.ctx).WithError(err).Warn("get runtime version failed")
+	}
+	agent.Runtime = runtime
+	containerList, err := b.source.List(b.ctx)
+	if err != nil {
+		utils.G(b.ctx).WithError(err).Warn("list containers failed")
+	}
+	agent.Containers = len(containerList)
+	return agent
+}
+
 func (b *Bridge) Add(containerId string) {
 	b.Lock()
 	defer b.Unlock()
+	defer b.updateGauges()
 	b.add(containerId, false)
 }
 
+// Update re-evaluates a container after its metadata changed. The services
+// of a tracked container are reconciled, a running container that had no
+// services is added.
+func (b *Bridge) Update(containerId string) {
+	b.Lock()
+	defer b.Unlock()
+	defer b.updateGauges()
+
+	if b.services[containerId] != nil {
+		b.reconcile(containerId)
+		return
+	}
+
+	state, err := b.source.Status(b.ctx, containerId)
+	if err != nil || state != StateRunning {
+		return
+	}
+	// restart probes and readiness with the new services
+	b.stopWarmup(containerId)
+	b.add(containerId, true)
+}
+
 func (b *Bridge) Remove(containerId string) {
 	b.remove(containerId, true)
 }
@@ -89,6 +280,7 @@ func (b *Bridge) RemoveOnExit(containerId string) {
 func (b *Bridge) Refresh() {
 	b.Lock()
 	defer b.Unlock()
+	defer b.updateGauges()
 
 	for containerId, deadContainer := range b.deadContainers {
 		deadContainer.TTL -= b.config.RefreshInterval
@@ -97,112 +289,312 @@ func (b *Bridge) Refresh() {
 		}
 	}
 
-	for containerId, services := range b.services {
+	if !b.caps.TTL {
+		return
+	}
+	for _, services := range b.services {
 		for _, service := range services {
-			err := b.registry.Refresh(service)
+			err := b.refresh(service)
 			if err != nil {
-				log.Println("refresh failed:", service.ID, err)
+				b.serviceLog(service).WithError(err).Error("refresh failed")
 				continue
 			}
-			log.Println("refreshed:", containerId, service.ID)
+			b.serviceLog(service).Debug("refreshed")
 		}
 	}
 }
 
+// Services returns a snapshot of the services currently tracked per container.
+func (b *Bridge) Services() map[string][]*Service {
+	b.Lock()
+	defer b.Unlock()
+
+	out := make(map[string][]*Service, len(b.services))
+	for containerId, services := range b.services {
+		out[containerId] = append([]*Service(nil), services...)
+	}
+	return out
+}
+
+// DeadContainers returns a snapshot of the exited containers whose services
+// are kept until their TTL expires.
+func (b *Bridge) DeadContainers() map[string]DeadContainer {
+	b.Lock()
+	defer b.Unlock()
+
+	out := make(map[string]DeadContainer, len(b.deadContainers))
+	for containerId, deadContainer := range b.deadContainers {
+		out[containerId] = DeadContainer{
+			TTL:      deadContainer.TTL,
+			Services: append([]*Service(nil), deadContainer.Services...),
+		}
+	}
+	return out
+}
+
+// LastSync returns the time the last Sync completed, or the zero time if no
+// Sync has completed yet.
+func (b *Bridge) LastSync() time.Time {
+	b.Lock()
+	defer b.Unlock()
+	return b.lastSync
+}
+
+// Reregister deregisters every service of a container and registers it
+// again from the current container state.
+func (b *Bridge) Reregister(containerId string) []*Service {
+	b.Lock()
+	defer b.Unlock()
+	defer b.updateGauges()
+
+	for _, service := range b.services[containerId] {
+		err := b.deregister(service)
+		if err != nil {
+			b.serviceLog(service).WithError(err).Error("deregister failed")
+		}
+	}
+	delete(b.services, containerId)
+	delete(b.deadContainers, containerId)
+	b.stopWarmup(containerId)
+
+	b.add(containerId, false)
+	return append([]*Service(nil), b.services[containerId]...)
+}
+
+// CheckRuntime reports whether the container runtime is reachable.
+func (b *Bridge) CheckRuntime() error {
+	return b.source.Ping(b.ctx)
+}
+
+// CheckRegistry reports whether the registry backend is reachable.
+func (b *Bridge) CheckRegistry() error {
+	b.Lock()
+	timeout := b.config.AdapterTimeout
+	agentId := b.agentId
+	b.Unlock()
+	return b.guard.call(func() error {
+		ctx, cancel := b.opContext(timeout)
+		defer cancel()
+		return b.registry.Ping(ctx, agentId)
+	})
+}
+
 func (b *Bridge) Sync(quiet bool) {
 	b.Lock()
 	defer b.Unlock()
+	defer b.updateGauges()
 
-	containerList, err := b.ctrClient.Containers(b.ctx)
+	start := time.Now()
+
+	containerList, err := b.source.List(b.ctx)
 	if err != nil && quiet {
-		log.Println("error container containerList, skipping sync")
+		utils.G(b.ctx).WithError(err).Error("error listing containers, skipping sync")
 		return
 	} else if err != nil && !quiet {
-		log.Fatal(err)
+		utils.G(b.ctx).WithError(err).Fatal("error listing containers")
 	}
 
-	for _, container := range containerList {
-		services := b.services[container.ID()]
+	b.beginBatch()
+	for _, containerId := range containerList {
+		services := b.services[containerId]
 
 		if services == nil {
-			b.add(container.ID(), quiet)
+			b.add(containerId, quiet)
 		} else {
 			for _, service := range services {
-				if err != nil {
-					log.Println("sync register failed:", service, err)
-				}
-
-				err = b.registry.Register(service)
-				if err != nil {
-					log.Println("sync register failed:", service, err)
-				}
+				service := service
+				b.registerThen(service, false, func(err error) {
+					if err != nil {
+						b.serviceLog(service).WithError(err).Error("sync register failed")
+					}
+				})
 			}
 		}
 	}
+	b.endBatch()
 
 	if b.config.Cleanup {
-		nonExitedContainers := make(map[string]containerd.Container)
-		for _, container := range containerList {
-			containerStatus, _ := ctrclient.GetContainerStatus(b.ctx, b.ctrClient, container.ID())
-			if containerStatus.Status == containerd.Running {
-				nonExitedContainers[container.ID()] = container
-			}
+		b.cleanup(containerList)
+	}
+
+	b.lastSync = time.Now()
+	metrics.ObserveSync(start)
+}
+
+// Cleanup removes stale and dangling services without re-registering the
+// running containers, regardless of the -cleanup setting.
+func (b *Bridge) Cleanup() error {
+	b.Lock()
+	defer b.Unlock()
+
+	containerList, err := b.source.List(b.ctx)
+	if err != nil {
+		return err
+	}
+	b.cleanup(containerList)
+	return nil
+}
+
+func (b *Bridge) cleanup(containerList []string) {
+	nonExitedContainers := make(map[string]bool)
+	for _, containerId := range containerList {
+		state, _ := b.source.Status(b.ctx, containerId)
+		if state == StateRunning || state == StatePaused {
+			nonExitedContainers[containerId] = true
 		}
+	}
 
-		for listingId, _ := range b.services {
-			found := false
-			for _, container := range nonExitedContainers {
-				if listingId == container.ID() {
-					found = true
-					break
-				}
-			}
-			// This is a container that does not exist
-			if !found {
-				log.Printf("stale: Removing service %s because it does not exist", listingId)
-				go b.RemoveOnExit(listingId)
-			}
+	for listingId, _ := range b.services {
+		// This is a container that does not exist
+		if !nonExitedContainers[listingId] {
+			b.containerLog(listingId).Info("stale: removing services because the container does not exist")
+			go b.RemoveOnExit(listingId)
 		}
+	}
+	for containerId := range b.unready {
+		if !nonExitedContainers[containerId] && b.services[containerId] == nil {
+			delete(b.unready, containerId)
+		}
+	}
 
-		log.Println("Cleaning up dangling services")
-		extServices, err := b.registry.Services(b.agentId)
-		if err != nil {
-			log.Println("cleanup failed:", err)
-			return
+	utils.G(b.ctx).Info("cleaning up dangling services")
+	var extServices []*Service
+	timeout := b.config.AdapterTimeout
+	err := b.guard.call(func() (err error) {
+		ctx, cancel := b.opContext(timeout)
+		defer cancel()
+		extServices, err = b.registry.Services(ctx, b.agentId)
+		return err
+	})
+	if err != nil {
+		utils.G(b.ctx).WithError(err).Error("cleanup failed")
+		return
+	}
+
+	var dangling []*Service
+	for _, extService := range extServices {
+		if b.dangling(extService) {
+			b.serviceLog(extService).Info("dangling")
+			dangling = append(dangling, extService)
 		}
+	}
+	b.removeDangling(dangling, len(extServices))
+}
 
-	Outer:
-		for _, extService := range extServices {
-			matches := serviceIDPattern.FindStringSubmatch(extService.ID)
-			if len(matches) != 3 {
-				// There's no way this was registered by us, so leave it
-				continue
-			}
-			serviceHostname := matches[1]
+// queued copies a service for an operation that may be queued. The drain
+// runs it without the bridge lock, so it must not share the service the
+// bridge tracks.
+func queued(service *Service) *Service {
+	copied := *service
+	return &copied
+}
 
-			if serviceHostname != Hostname {
-				// ignore because registered on a different host
-				continue
-			}
-			serviceContainerName := matches[2]
-			for _, listing := range b.services {
-				for _, service := range listing {
-					if service.Name == extService.Name && serviceContainerName == service.Origin.container.Name {
-						continue Outer
-					}
-				}
-			}
-			log.Println("dangling:", extService.ID)
-			err := b.registry.Deregister(extService)
-			if err != nil {
-				log.Println("deregister failed:", extService.ID, err)
-				continue
+// withAgent returns a copy of a service moved to an agent ID.
+func withAgent(service *Service, agentId string) *Service {
+	copied := *service
+	copied.AgentId = agentId
+	return &copied
+}
+
+// dropped forgets the services of the container whose registration the
+// guard gave up on, so that the next sync or event of the container
+// registers them again.
+func (b *Bridge) dropped(op string, serviceId string) {
+	if op != "register" && op != "update" {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	defer b.updateGauges()
+	for containerId, services := range b.services {
+		for _, service := range services {
+			if service.ID == serviceId {
+				b.containerLog(containerId).WithField("service", serviceId).Warn("registration dropped, registering again on the next sync")
+				delete(b.services, containerId)
+				return
 			}
-			log.Println(extService.ID, "removed")
 		}
 	}
 }
 
+func (b *Bridge) register(service *Service) error {
+	service = queued(service)
+	timeout := b.config.AdapterTimeout
+	return b.guard.do("register", service.ID, func() error {
+		ctx, cancel := b.opContext(timeout)
+		defer cancel()
+		start := time.Now()
+		err := b.registry.Register(ctx, service)
+		metrics.ObserveRegistry(b.scheme, "register", start, err)
+		return err
+	})
+}
+
+func (b *Bridge) deregister(service *Service) error {
+	service = queued(service)
+	timeout := b.config.AdapterTimeout
+	return b.guard.do("deregister", service.ID, func() error {
+		ctx, cancel := b.opContext(timeout)
+		defer cancel()
+		start := time.Now()
+		err := b.registry.Deregister(ctx, service)
+		metrics.ObserveRegistry(b.scheme, "deregister", start, err)
+		return err
+	})
+}
+
+func (b *Bridge) update(service *Service) error {
+	service = queued(service)
+	timeout := b.config.AdapterTimeout
+	return b.guard.do("update", service.ID, func() error {
+		ctx, cancel := b.opContext(timeout)
+		defer cancel()
+		start := time.Now()
+		err := b.registry.Update(ctx, service)
+		metrics.ObserveRegistry(b.scheme, "update", start, err)
+		return err
+	})
+}
+
+func (b *Bridge) refresh(service *Service) error {
+	service = queued(service)
+	timeout := b.config.AdapterTimeout
+	return b.guard.do("refresh", service.ID, func() error {
+		ctx, cancel := b.opContext(timeout)
+		defer cancel()
+		start := time.Now()
+		err := b.registry.Refresh(ctx, service)
+		metrics.ObserveRegistry(b.scheme, "refresh", start, err)
+		return err
+	})
+}
+
+func (b *Bridge) containerLog(containerId string) *utils.Entry {
+	return utils.G(b.ctx).WithField("container", containerId)
+}
+
+func (b *Bridge) serviceLog(service *Service) *utils.Entry {
+	fields := utils.Fields{"service": service.ID}
+	if service.Origin.ContainerID != "" {
+		fields["container"] = service.Origin.ContainerID
+	}
+	if pod := service.Origin.container.PodName(); pod != "" {
+		fields["pod"] = pod
+	}
+	return utils.G(b.ctx).WithFields(fields)
+}
+
+// updateGauges must be called with the lock held.
+func (b *Bridge) updateGauges() {
+	count := 0
+	for _, services := range b.services {
+		count += len(services)
+	}
+	metrics.Services.Set(float64(count))
+	metrics.DeadContainers.Set(float64(len(b.deadContainers)))
+	metrics.FlappingContainers.Set(float64(b.flappingContainers()))
+}
+
 func (b *Bridge) add(containerId string, quiet bool) {
 	if d := b.deadContainers[containerId]; d != nil {
 		b.services[containerId] = d.Services
@@ -210,108 +602,226 @@ func (b *Bridge) add(containerId string, quiet bool) {
 	}
 
 	if b.services[containerId] != nil {
-		log.Println("container ", containerId, ", already exists, ignoring")
+		b.containerLog(containerId).Debug("container already exists, ignoring")
+		return
+	}
+	if b.warmups[containerId] != nil {
+		b.containerLog(containerId).Debug("container is warming up, ignoring")
+		return
+	}
+	if b.paused[containerId] {
+		b.containerLog(containerId).Debug("container is paused, ignoring")
 		return
 	}
 
-	k8SScheduleContainer, err := b.getK8SScheduleContainer(containerId)
+	services, err := b.newServices(containerId, quiet)
 	if err != nil {
-		log.Println("get k8s schedule container failed:", containerId, err)
+		b.containerLog(containerId).WithError(err).Error("get k8s schedule container failed")
 		return
 	}
 
-	if k8SScheduleContainer == nil {
-		log.Println("container kind is sandbox or container not exist:", containerId)
+	damped, started := b.flapping(containerId, services)
+	if started {
+		b.dampServices(services)
+	}
+	if damped && b.flapPolicy() == FlapSuppress {
+		return
+	}
+
+	podUid, ready := b.podReady(services)
+	if !ready {
+		b.unready[containerId] = podUid
+		if b.readinessPolicy != ReadinessCritical {
+			if !quiet {
+				b.containerLog(containerId).Info("pending: pod is not ready")
+			}
+			return
+		}
+	} else {
+		delete(b.unready, containerId)
+	}
+
+	if b.config.Warmup && !damped {
+		b.startWarmup(containerId, services)
 		return
 	}
+	for _, service := range services {
+		b.addService(containerId, service, ready)
+	}
+}
+
+// addService registers a service of a container and tracks it. It must be
+// called with the lock held.
+func (b *Bridge) addService(containerId string, service *Service, ready bool) {
+	b.serviceLog(service).WithField("payload", service.RedactedJSON()).Debug("register service")
+
+	// the agent may have been registered again while the service warmed up
+	// or waited for its pod
+	service = withAgent(service, b.agentId)
+	b.registerThen(service, false, func(err error) {
+		if err != nil {
+			b.serviceLog(service).WithError(err).Error("register failed")
+			return
+		}
+		b.services[containerId] = append(b.services[containerId], service)
+		b.serviceLog(service).Info("added")
+		if !ready {
+			b.setMaintenance(service, true, "pod is not ready")
+		}
+		if b.damped(containerId) && b.flapPolicy() == FlapCritical {
+			b.setStatus(b.statusAdapter(), service, HealthCritical, "container is flapping")
+		}
+	})
+}
+
+// newServices builds the services of a container without registering them.
+func (b *Bridge) newServices(containerId string, quiet bool) ([]*Service, error) {
+	k8SScheduleContainer, err := b.source.Inspect(b.ctx, containerId)
+	if err != nil {
+		return nil, err
+	}
+
+	if k8SScheduleContainer == nil {
+		b.containerLog(containerId).Debug("container kind is sandbox or container not exist")
+		return nil, nil
+	}
 
 	ports := make(map[string]ServicePort)
 	b.extractK8SSchedulePorts(k8SScheduleContainer, ports)
 
 	if len(ports) == 0 && !quiet {
-		log.Println("ignored:", containerId, "no published ports")
-		return
+		b.containerLog(containerId).Info("ignored: no published ports")
+		return nil, nil
 	}
 
+	var services []*Service
 	isGroup := len(ports) > 1
 	for _, port := range ports {
 		service := b.newService(port, isGroup)
 		if service == nil {
 			if !quiet {
-				log.Println("ignored:", k8SScheduleContainer.ID, "service on port", port.ExposedPort)
+				b.containerLog(k8SScheduleContainer.ID).WithField("port", port.ExposedPort).Info("ignored: service on port")
 			}
 			continue
 		}
-		json2, _ := json.Marshal(service)
-		log.Println("register service:", string(json2))
-
-		err := b.registry.Register(service)
-		if err != nil {
-			log.Println("register failed:", service, err)
-			continue
-		}
-		b.services[k8SScheduleContainer.ID] = append(b.services[k8SScheduleContainer.ID], service)
-		log.Println("added:", k8SScheduleContainer.ID, service.ID)
+		services = append(services, b.networkServices(service)...)
 	}
+	return services, nil
 }
 
-func (b *Bridge) getK8SScheduleContainer(containerId string) (*K8SScheduleContainer, error) {
-	container, err := b.ctrClient.ContainerService().Get(b.ctx, containerId)
-	if err != nil {
-		return nil, errors.Join(fmt.Errorf("get container info failed %s", containerId), err)
+// Reconcile recomputes the services of every tracked container and applies
+// the differences to the registry, e.g. after the configuration changed.
+func (b *Bridge) Reconcile() {
+	b.Lock()
+	defer b.Unlock()
+	defer b.updateGauges()
+
+	containerIds := make([]string, 0, len(b.services))
+	for containerId := range b.services {
+		containerIds = append(containerIds, containerId)
 	}
+	b.beginBatch()
+	for _, containerId := range containerIds {
+		b.reconcile(containerId)
+	}
+	b.endBatch()
+}
 
-	podId := container.Labels[ctrclient.PodUid]
-	if podId == "" {
-		return nil, nil
+// reconcile registers the services of a container that are new or changed
+// and deregisters the ones that no longer apply. Unchanged services are left
+// alone. It must be called with the lock held.
+func (b *Bridge) reconcile(containerId string) {
+	desired, err := b.newServices(containerId, true)
+	if err != nil {
+		b.containerLog(containerId).WithError(err).Error("reconcile failed")
+		return
 	}
 
-	kind := container.Labels["io.cri-containerd.kind"]
-	if kind != "container" {
-		return nil, nil
+	current := make(map[string]*Service, len(b.services[containerId]))
+	for _, service := range b.services[containerId] {
+		current[service.ID] = service
 	}
 
-	containerMetaData := container.Extensions[ctrclient.K8sLabelsContainerMetadata]
-	if containerMetaData == nil || containerMetaData.GetValue() == nil {
-		return nil, nil
+	var services []*Service
+	var changed [][2]*Service
+	for _, service := range desired {
+		old := current[service.ID]
+		delete(current, service.ID)
+		if old != nil && old.Equal(service) {
+			services = append(services, old)
+			continue
+		}
+		changed = append(changed, [2]*Service{service, old})
 	}
-	var containerMeta ctrclient.ContainerMetadata
-	err = containerMeta.Unmarshal(containerMetaData)
-	if err != nil {
-		return nil, errors.Join(fmt.Errorf("unmarshal ContainerMetadata error %s", container.ID), err)
+	if len(services) == 0 {
+		delete(b.services, containerId)
+	} else {
+		b.services[containerId] = services
 	}
 
-	sandboxId := containerMeta.Metadata.SandBoxID
+	// registered services are tracked as their result comes in
+	for _, pair := range changed {
+		service, old := pair[0], pair[1]
+		b.registerThen(service, old != nil, func(err error) {
+			if err != nil {
+				b.serviceLog(service).WithError(err).Error("register failed")
+				if old != nil {
+					b.services[containerId] = append(b.services[containerId], old)
+				}
+				return
+			}
+			b.services[containerId] = append(b.services[containerId], service)
+			if old != nil {
+				b.serviceLog(service).Info("updated")
+			} else {
+				b.serviceLog(service).Info("added")
+			}
+		})
+	}
 
-	sandboxContainerInfo, err := b.ctrClient.ContainerService().Get(b.ctx, sandboxId)
-	if err != nil {
-		return nil, errors.Join(fmt.Errorf("get container sandbox failed %s", sandboxId), err)
+	for _, service := range current {
+		service := service
+		b.deregisterThen(service, func(err error) {
+			if err != nil {
+				b.serviceLog(service).WithError(err).Error("deregister failed")
+				return
+			}
+			b.serviceLog(service).Info("removed")
+		})
 	}
+}
 
-	sandBoxMetaData := sandboxContainerInfo.Extensions[ctrclient.K8sLabelsSandboxMetadata]
+// SetConfig applies a new configuration to the running bridge. Settings that
+// are baked into already registered services or into the agent registration
+// cannot be changed and are rejected. Call Reconcile afterwards to apply the
+// changes to the registered services.
+func (b *Bridge) SetConfig(config Config) error {
+	b.Lock()
+	defer b.Unlock()
 
-	var sandboxMeta ctrclient.ContainerMetadata
-	err = sandboxMeta.Unmarshal(sandBoxMetaData)
-	if err != nil {
-		return nil, errors.Join(fmt.Errorf("unmarshal SandboxMetadata failed %s", sandboxId), err)
+	var errs []error
+	if config.HostIp != b.config.HostIp {
+		errs = append(errs, errors.New("changing the host ip requires a restart"))
 	}
-
-	var containerSpec ctrclient.ContainerSpec
-	err = containerSpec.Unmarshal(container.Spec)
-	if err != nil {
-		return nil, errors.Join(fmt.Errorf("unmarshal containerSpec failed %s", container.ID), err)
+	if config.Internal != b.config.Internal {
+		errs = append(errs, errors.New("changing internal requires a restart"))
+	}
+	if config.UseIpFromLabel != b.config.UseIpFromLabel {
+		errs = append(errs, errors.New("changing useIpFromLabel requires a restart"))
+	}
+	if config.DataCenterId != b.config.DataCenterId {
+		errs = append(errs, errors.New("changing the data center id requires a restart"))
+	}
+	if config.InstanceId != b.config.InstanceId {
+		errs = append(errs, errors.New("changing the instance id requires a restart"))
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
 	}
 
-	var k8sContainer K8SScheduleContainer
-	k8sContainer.ID = containerId
-	k8sContainer.Container = &container
-	k8sContainer.ContainerMetadata = &containerMeta
-	k8sContainer.ContainerSpec = &containerSpec
-	k8sContainer.SandBoxContainer = &sandboxContainerInfo
-	k8sContainer.SandBoxMetadata = &sandboxMeta
-	k8sContainer.Name = k8sContainer.ContainerMetadata.Metadata.Name
-
-	return &k8sContainer, nil
+	b.config = config
+	b.reportUnsupported(config)
+	return nil
 }
 
 func (b *Bridge) shouldRemove(containerId string) bool {
@@ -319,11 +829,11 @@ func (b *Bridge) shouldRemove(containerId string) bool {
 		return true
 	}
 
-	status, err := ctrclient.GetContainerStatus(b.ctx, b.ctrClient, containerId)
+	state, err := b.source.Status(b.ctx, containerId)
 	if err != nil {
 		return false
 	}
-	if status.Status == containerd.Running {
+	if state == StateRunning {
 		return false
 	}
 	return true
@@ -340,30 +850,40 @@ func (b *Bridge) extractK8SSchedulePorts(k8SScheduleContainer *K8SScheduleContai
 
 	ignoreEnv := k8SScheduleContainer.ContainerSpec.GetEnv("SERVICE_IGNORE")
 	if ignoreEnv != "" {
-		log.Println("ignored:", k8SScheduleContainer.ID, "ignore env set")
+		b.containerLog(k8SScheduleContainer.ID).Info("ignored: ignore env set")
 		return
 	}
 
-	portsJSON := containerMeta.Metadata.Config.Annotations["io.kubernetes.container.ports"]
+	portsJSON := containerMeta.Metadata.Config.Annotations[ctrclient.ContainerPortsAnnotation]
 	if len(portsJSON) <= 0 {
 		return
 	}
 
 	portMappings, err := containerMeta.GetPortMapping()
 	if err != nil {
-		log.Println("Get container port mapping error", k8SScheduleContainer.ID, err)
+		b.containerLog(k8SScheduleContainer.ID).WithError(err).Error("get container port mapping failed")
 		return
 	}
+	exposedIP := sandboxMeta.Metadata.IP
+	if addresses := b.addresses(podIPs(k8SScheduleContainer)); len(addresses) > 0 {
+		exposedIP = addresses[0]
+	}
 	for _, portMapping := range portMappings {
 		servicePort := ServicePort{
 			ContainerID:       k8SScheduleContainer.ID,
 			PortType:          strings.ToLower(portMapping.Protocol),
 			ContainerName:     containerMeta.Metadata.Name,
 			ExposedPort:       strconv.Itoa(portMapping.ContainerPort),
-			ExposedIP:         sandboxMeta.Metadata.IP,
+			ExposedIP:         exposedIP,
 			ContainerHostname: containerSpec.GetEnv("HOSTNAME"),
 			container:         k8SScheduleContainer,
 		}
+		// pod IPs are routable, only the ports of other containers are
+		// published on the host
+		if !k8SScheduleContainer.Kubernetes() && portMapping.HostPort > 0 {
+			servicePort.HostPort = strconv.Itoa(portMapping.HostPort)
+			servicePort.HostIP = portMapping.HostIP
+		}
 
 		ports[servicePort.ExposedPort] = servicePort
 	}
@@ -381,7 +901,7 @@ func (b *Bridge) newService(port ServicePort, isGroup bool) *Service {
 
 	serviceName := mapDefault(metadata, "name", "")
 	if serviceName == "" {
-		log.Println("ignored:", container.ID, "service name not set")
+		b.containerLog(container.ID).WithField("port", port.ExposedPort).Info("ignored: service name not set")
 		return nil
 	}
 
@@ -389,57 +909,161 @@ func (b *Bridge) newService(port ServicePort, isGroup bool) *Service {
 		serviceName += "-" + port.ExposedPort
 	}
 
-	p, err := strconv.Atoi(port.ExposedPort)
+	network := mapDefault(metadata, "network", "")
+	ip, servicePort := port.ExposedIP, port.ExposedPort
+	if port.HostPort != "" && !b.config.Internal {
+		// published on the host, the networks of the container do not apply
+		network = ""
+		ip, servicePort = port.HostIP, port.HostPort
+		if ip == "" || ip == "0.0.0.0" || ip == "::" {
+			ip = b.config.HostIp
+		}
+		if ip == "" {
+			b.containerLog(container.ID).WithField("port", port.ExposedPort).Info("ignored: published port needs -ip or -internal")
+			return nil
+		}
+	}
+
+	p, err := strconv.Atoi(servicePort)
 	if err != nil {
-		log.Println("Parse ExposedPort port error", port.ExposedPort, err)
+		b.containerLog(container.ID).WithField("port", servicePort).WithError(err).Error("parse port failed")
 		return nil
 	}
 
 	nodeHostname := Hostname
 
+	var sensitive []string
+	for _, key := range strings.Split(mapDefault(metadata, "sensitive", ""), ",") {
+		if key = strings.ToLower(strings.TrimSpace(key)); key != "" {
+			sensitive = append(sensitive, key)
+		}
+	}
+
+	tags := mapDefault(metadata, "tags", "")
+	id := mapDefault(metadata, "id", "")
+
 	delete(metadata, "id")
 	delete(metadata, "tags")
 	delete(metadata, "name")
+	delete(metadata, "sensitive")
+	delete(metadata, "network")
 
 	service := new(Service)
 	service.Origin = port
 	service.ID = nodeHostname + ":" + container.Name + ":" + port.ExposedPort
+	if namespace := idNamespace(container); namespace != "" {
+		service.ID = nodeHostname + ":" + namespace + ":" + container.Name + ":" + port.ExposedPort
+	}
 	service.Name = serviceName
 	service.Port = p
-	service.IP = port.ExposedIP
+	service.IP = ip
+	service.IPs = b.addresses(podIPs(container))
+	if len(service.IPs) == 0 || service.IPs[0] != ip {
+		// published on the host
+		service.IPs = []string{ip}
+	}
 	service.Attrs = metadata
+	service.Sensitive = sensitive
 	service.TTL = b.config.RefreshTtl
+	service.AgentId = b.agentId
+	service.Origin.Network = network
 
 	if port.PortType == "udp" {
-		service.Tags = combineTags(
-			mapDefault(metadata, "tags", ""), b.config.ForceTags, "udp")
+		service.Tags = combineTags(tags, b.config.ForceTags, "udp")
 		service.ID = service.ID + ":udp"
 	} else {
-		service.Tags = combineTags(
-			mapDefault(metadata, "tags", ""), b.config.ForceTags)
+		service.Tags = combineTags(tags, b.config.ForceTags)
 	}
 
-	id := mapDefault(metadata, "id", "")
 	if id != "" {
 		service.ID = id
 	}
+	b.stampOwnership(service)
 
 	return service
 }
 
+// networkServices applies SERVICE_NETWORK to a service. A network name
+// registers the service with the address of the container on that network,
+// "*" registers one service per network, tagged with the network name. The
+// service on the primary address keeps its ID, the others get the network
+// appended.
+func (b *Bridge) networkServices(service *Service) []*Service {
+	network := service.Origin.Network
+	if network == "" {
+		return []*Service{service}
+	}
+	container := service.Origin.container
+
+	if network != "*" {
+		for _, attachment := range container.Networks {
+			if addresses := b.addresses(attachment.IPs); attachment.Network == network && len(addresses) > 0 {
+				service.IP = addresses[0]
+				service.IPs = addresses
+				service.Origin.ExposedIP = service.IP
+				return []*Service{service}
+			}
+		}
+		b.serviceLog(service).WithField("network", network).Info("ignored: container is not attached to network")
+		return nil
+	}
+
+	attached := make(map[string]int)
+	for _, attachment := range container.Networks {
+		attached[attachment.Network]++
+	}
+	var services []*Service
+	for _, attachment := range container.Networks {
+		addresses := b.addresses(attachment.IPs)
+		if len(addresses) == 0 {
+			continue
+		}
+		networkService := *service
+		networkService.IP = addresses[0]
+		networkService.IPs = addresses
+		networkService.Origin.ExposedIP = networkService.IP
+		networkService.Origin.Network = attachment.Network
+		networkService.Tags = append(append([]string(nil), service.Tags...), attachment.Network)
+		if networkService.IP != service.IP {
+			suffix := attachment.Network
+			if attached[attachment.Network] > 1 {
+				suffix += "-" + attachment.Interface
+			}
+			networkService.ID += ":" + suffix
+		}
+		services = append(services, &networkService)
+	}
+	if len(services) == 0 {
+		service.Origin.Network = ""
+		return []*Service{service}
+	}
+	return services
+}
+
+// idNamespace returns the namespace that is part of the service IDs of a
+// container. Names are only unique within a namespace, but the IDs of
+// Kubernetes containers are kept as they were before namespaces were watched.
+func idNamespace(container *K8SScheduleContainer) string {
+	if container == nil || container.Namespace == ctrclient.K8sNamespace {
+		return ""
+	}
+	return container.Namespace
+}
+
 func (b *Bridge) remove(containerId string, deregister bool) {
 	b.Lock()
 	defer b.Unlock()
+	defer b.updateGauges()
 
 	if deregister {
 		deregisterAll := func(services []*Service) {
 			for _, service := range services {
-				err := b.registry.Deregister(service)
+				err := b.deregister(service)
 				if err != nil {
-					log.Println("deregister failed:", service.ID, err)
+					b.serviceLog(service).WithError(err).Error("deregister failed")
 					continue
 				}
-				log.Println("removed:", containerId, service.ID)
+				b.serviceLog(service).Info("removed")
 			}
 		}
 		deregisterAll(b.services[containerId])
@@ -452,13 +1076,25 @@ func (b *Bridge) remove(containerId string, deregister bool) {
 		b.deadContainers[containerId] = &DeadContainer{b.config.RefreshTtl, b.services[containerId]}
 	}
 	delete(b.services, containerId)
+	delete(b.unready, containerId)
+	delete(b.paused, containerId)
+	b.stopWarmup(containerId)
+	b.stopOOMWarning(containerId)
+	b.flapStopped(containerId)
 }
 
+// serviceMetaData reads the SERVICE_* environment variables and container
+// labels, labels take precedence so that they can be changed at runtime.
 func serviceMetaData(container *K8SScheduleContainer, port string) (map[string]string, map[string]bool) {
-	meta := container.ContainerMetadata.Metadata.Config.Envs
-	//for k, v := range container.Labels {
-	//	meta = append(meta, k+"="+v)
-	//}
+	meta := append([]ctrclient.EnvMetadata(nil), container.ContainerMetadata.Metadata.Config.Envs...)
+	labelKeys := make([]string, 0, len(container.Labels))
+	for k := range container.Labels {
+		labelKeys = append(labelKeys, k)
+	}
+	sort.Strings(labelKeys)
+	for _, k := range labelKeys {
+		meta = append(meta, ctrclient.EnvMetadata{Key: k, Value: container.Labels[k]})
+	}
 	metadata := make(map[string]string)
 	metadataFromPort := make(map[string]bool)
 	for _, kv := range meta {
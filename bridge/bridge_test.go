@@ -0,0 +1,349 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"registrator-containerd/pkg/ctrclient"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var schemes atomic.Int32
+
+// newTestBridge returns a bridge over a fake source and a fake adapter that
+// is registered under a scheme of its own.
+func newTestBridge(t *testing.T, config Config) (*Bridge, *FakeSource, *FakeAdapter) {
+	t.Helper()
+	source := NewFakeSource()
+	adapter := NewFakeAdapter()
+	scheme := fmt.Sprintf("fake%d", schemes.Add(1))
+	Register(&FakeFactory{Adapter: adapter}, scheme)
+	t.Cleanup(func() { Unregister(scheme) })
+
+	if config.DeregisterCheck == "" {
+		config.DeregisterCheck = "always"
+	}
+	if config.BatchSize == 0 {
+		config.BatchSize = 1
+	}
+	if config.BatchInterval == 0 {
+		config.BatchInterval = 1000
+	}
+	b, err := New(source, scheme+"://", config, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	adapter.Calls()
+	return b, source, adapter
+}
+
+// putPod adds a running pod container with a service on each port.
+func putPod(t *testing.T, source *FakeSource, name string, ports ...int) string {
+	t.Helper()
+	var mappings []ctrclient.PortMapping
+	for _, port := range ports {
+		mappings = append(mappings, ctrclient.PortMapping{ContainerPort: port, Protocol: "TCP"})
+	}
+	container := NewFakeContainer(t, FakeContainer{
+		ID:           "k8s.io/" + name,
+		Name:         name,
+		Namespace:    ctrclient.K8sNamespace,
+		PodUID:       "uid-" + name,
+		PodName:      name,
+		PodNamespace: "default",
+		SandboxID:    "sandbox-" + name,
+		IP:           "10.0.0.2",
+		Ports:        mappings,
+		Env:          map[string]string{"SERVICE_NAME": name},
+	})
+	source.Put(container, StateRunning)
+	return container.ID
+}
+
+func serviceId(name string, port int) string {
+	return fmt.Sprintf("%s:%s:%d", Hostname, name, port)
+}
+
+func assertCalls(t *testing.T, adapter *FakeAdapter, want ...string) {
+	t.Helper()
+	if got := adapter.Calls(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("calls = %q, want %q", got, want)
+	}
+}
+
+func TestAddRegistersServices(t *testing.T) {
+	b, source, adapter := newTestBridge(t, Config{})
+	id := putPod(t, source, "web", 80, 8080)
+
+	b.Add(id)
+
+	// the ports of a container are not ordered
+	calls := adapter.Calls()
+	sort.Strings(calls)
+	if want := []string{"register:" + serviceId("web", 80), "register:" + serviceId("web", 8080)}; !reflect.DeepEqual(calls, want) {
+		t.Fatalf("calls = %q, want %q", calls, want)
+	}
+	if got := len(b.Services()[id]); got != 2 {
+		t.Fatalf("tracked services = %d, want 2", got)
+	}
+	service := b.Services()[id][0]
+	if service.IP != "10.0.0.2" || service.AgentId != "fake-agent-1" {
+		t.Fatalf("service = %+v", service)
+	}
+	if service.Attrs[AttrContainer] != id || service.Attrs[AttrPodUid] != "uid-web" {
+		t.Fatalf("ownership attrs = %v", service.Attrs)
+	}
+}
+
+func TestAddIgnoresContainersWithoutServiceName(t *testing.T) {
+	b, source, adapter := newTestBridge(t, Config{Explicit: true})
+	container := NewFakeContainer(t, FakeContainer{
+		ID:        "k8s.io/plain",
+		Name:      "plain",
+		Namespace: ctrclient.K8sNamespace,
+		PodUID:    "uid-plain",
+		IP:        "10.0.0.3",
+		Ports:     []ctrclient.PortMapping{{ContainerPort: 80, Protocol: "TCP"}},
+	})
+	source.Put(container, StateRunning)
+
+	b.Add(container.ID)
+
+	assertCalls(t, adapter)
+	if len(b.Services()) != 0 {
+		t.Fatalf("services = %v", b.Services())
+	}
+}
+
+func TestRemoveDeregistersServices(t *testing.T) {
+	b, source, adapter := newTestBridge(t, Config{})
+	id := putPod(t, source, "web", 80)
+	b.Add(id)
+	adapter.Calls()
+
+	b.Remove(id)
+
+	assertCalls(t, adapter, "deregister:"+serviceId("web", 80))
+	if len(b.Services()) != 0 || len(adapter.Registered()) != 0 {
+		t.Fatalf("services = %v, registered = %v", b.Services(), adapter.Registered())
+	}
+}
+
+func TestRemoveOnExitKeepsServicesUntilTheirTTL(t *testing.T) {
+	b, source, adapter := newTestBridge(t, Config{RefreshTtl: 30, RefreshInterval: 10, DeregisterCheck: "on-success"})
+	id := putPod(t, source, "web", 80)
+	b.Add(id)
+	adapter.Calls()
+
+	// on-success only deregisters tasks that are gone
+	b.RemoveOnExit(id)
+
+	assertCalls(t, adapter)
+	if _, ok := b.DeadContainers()[id]; !ok {
+		t.Fatalf("dead containers = %v", b.DeadContainers())
+	}
+}
+
+func TestSyncAddsNewAndRegistersKnownContainers(t *testing.T) {
+	b, source, adapter := newTestBridge(t, Config{})
+	known := putPod(t, source, "known", 80)
+	b.Add(known)
+	putPod(t, source, "fresh", 80)
+	adapter.Calls()
+
+	b.Sync(false)
+
+	assertCalls(t, adapter, "register:"+serviceId("fresh", 80), "register:"+serviceId("known", 80))
+	if len(b.Services()) != 2 {
+		t.Fatalf("services = %v", b.Services())
+	}
+}
+
+func TestSyncRemovesServicesOfVanishedContainers(t *testing.T) {
+	b, source, adapter := newTestBridge(t, Config{Cleanup: true})
+	id := putPod(t, source, "web", 80)
+	b.Add(id)
+	source.Delete(id)
+	adapter.Calls()
+
+	b.Sync(true)
+
+	// the stale container is removed in the background
+	deadline := time.Now().Add(time.Second)
+	for len(b.Services()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(b.Services()) != 0 || len(adapter.Registered()) != 0 {
+		t.Fatalf("services = %v, registered = %v", b.Services(), adapter.Registered())
+	}
+}
+
+func TestCleanupRemovesDanglingServicesOfTheInstance(t *testing.T) {
+	b, source, adapter := newTestBridge(t, Config{})
+	id := putPod(t, source, "web", 80)
+	b.Add(id)
+	adapter.Put(&Service{ID: "custom-id", Name: "gone", Attrs: map[string]string{AttrInstance: Hostname}})
+	adapter.Put(&Service{ID: "other-instance", Name: "gone", Attrs: map[string]string{AttrInstance: "elsewhere"}})
+	adapter.Put(&Service{ID: serviceId("legacy", 80), Name: "legacy"})
+	adapter.Put(&Service{ID: "otherhost:legacy:80", Name: "legacy"})
+	adapter.Calls()
+
+	if err := b.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertCalls(t, adapter, "services:fake-agent-1", "deregister:custom-id", "deregister:"+serviceId("legacy", 80))
+	want := []string{"other-instance", "otherhost:legacy:80", serviceId("web", 80)}
+	if got := adapter.Registered(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("registered = %q, want %q", got, want)
+	}
+}
+
+func TestHeartbeatRegistersLostAgentAndServices(t *testing.T) {
+	b, source, adapter := newTestBridge(t, Config{})
+	id := putPod(t, source, "web", 80)
+	b.Add(id)
+
+	if err := b.Heartbeat(); err != nil {
+		t.Fatal(err)
+	}
+	adapter.Calls()
+
+	adapter.ForgetAgent()
+	if err := b.Heartbeat(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertCalls(t, adapter, "ping:fake-agent-1", "agent:", "deregister:"+serviceId("web", 80), "register:"+serviceId("web", 80))
+	// the record under the lost agent is removed
+	if deregistered := adapter.Deregistered(); len(deregistered) != 1 || deregistered[0].AgentId != "fake-agent-1" {
+		t.Fatalf("deregistered = %+v", deregistered)
+	}
+	if got := b.Services()[id][0].AgentId; got != "fake-agent-2" {
+		t.Fatalf("agent id = %q, want fake-agent-2", got)
+	}
+	if service := adapter.Service(serviceId("web", 80)); service == nil || service.AgentId != "fake-agent-2" {
+		t.Fatalf("registered = %+v", service)
+	}
+	if agent := adapter.LastAgent(); agent.Runtime != "fake 0.1.0" || agent.Containers != 1 {
+		t.Fatalf("agent = %+v", agent)
+	}
+}
+
+func TestSyncBatchesRegistrations(t *testing.T) {
+	b, source, adapter := newTestBridge(t, Config{BatchSize: 2})
+	putPod(t, source, "a", 80)
+	putPod(t, source, "b", 80)
+	putPod(t, source, "c", 80)
+
+	b.Sync(false)
+
+	assertCalls(t, adapter, "register-batch:2", "register-batch:1")
+	if len(adapter.Registered()) != 3 {
+		t.Fatalf("registered = %v", adapter.Registered())
+	}
+}
+
+func TestBatchFallsBackToQueuedSingleOperations(t *testing.T) {
+	b, source, adapter := newTestBridge(t, Config{BatchSize: 10, BreakerFailures: 1, BreakerCooldown: 1})
+	putPod(t, source, "a", 80)
+	putPod(t, source, "b", 80)
+
+	adapter.Err = errors.New("backend down")
+	if err := b.CheckRegistry(); err == nil {
+		t.Fatal("registry check succeeded")
+	}
+	adapter.Err = nil
+	adapter.Calls()
+
+	b.Sync(false)
+	assertCalls(t, adapter)
+
+	// replayed one by one after the cooldown
+	deadline := time.Now().Add(3 * time.Second)
+	for len(adapter.Registered()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assertCalls(t, adapter, "register:"+serviceId("a", 80), "register:"+serviceId("b", 80))
+}
+
+func TestServiceIdAndTagsOverrideTheDefaults(t *testing.T) {
+	b, source, adapter := newTestBridge(t, Config{ForceTags: "forced"})
+	container := NewFakeContainer(t, FakeContainer{
+		ID:        "k8s.io/web",
+		Name:      "web",
+		Namespace: ctrclient.K8sNamespace,
+		PodUID:    "uid-web",
+		IP:        "10.0.0.2",
+		Ports:     []ctrclient.PortMapping{{ContainerPort: 80, Protocol: "TCP"}},
+		Env:       map[string]string{"SERVICE_NAME": "web", "SERVICE_ID": "web-primary", "SERVICE_TAGS": "a,b"},
+	})
+	source.Put(container, StateRunning)
+
+	b.Add(container.ID)
+
+	assertCalls(t, adapter, "register:web-primary")
+	service := b.Services()[container.ID][0]
+	tags := append([]string(nil), service.Tags...)
+	sort.Strings(tags)
+	if want := []string{"a", "b", "forced"}; !reflect.DeepEqual(tags, want) {
+		t.Fatalf("tags = %q, want %q", tags, want)
+	}
+	if _, ok := service.Attrs["id"]; ok {
+		t.Fatalf("attrs = %v", service.Attrs)
+	}
+}
+
+func TestHeartbeatMovesExitedContainersToTheNewAgent(t *testing.T) {
+	b, source, adapter := newTestBridge(t, Config{RefreshTtl: 30, RefreshInterval: 10, DeregisterCheck: "on-success"})
+	id := putPod(t, source, "web", 80)
+	b.Add(id)
+	b.RemoveOnExit(id)
+
+	adapter.ForgetAgent()
+	if err := b.Heartbeat(); err != nil {
+		t.Fatal(err)
+	}
+
+	dead, ok := b.DeadContainers()[id]
+	if !ok || dead.Services[0].AgentId != "fake-agent-2" {
+		t.Fatalf("dead container = %+v", dead)
+	}
+}
+
+func TestHeartbeatLeavesServiceSnapshotsAlone(t *testing.T) {
+	b, source, adapter := newTestBridge(t, Config{})
+	id := putPod(t, source, "web", 80)
+	b.Add(id)
+
+	// the admin API encodes a snapshot while the agent is registered again
+	snapshot := b.Services()[id][0]
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = snapshot.AgentId
+			runtime.Gosched()
+		}
+	}()
+	adapter.ForgetAgent()
+	if err := b.Heartbeat(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if snapshot.AgentId != "fake-agent-1" {
+		t.Fatalf("snapshot agent id = %q, want fake-agent-1", snapshot.AgentId)
+	}
+	if got := b.Services()[id][0].AgentId; got != "fake-agent-2" {
+		t.Fatalf("agent id = %q, want fake-agent-2", got)
+	}
+}
@@ -0,0 +1,80 @@
+package bridge
+
+import "registrator-containerd/utils"
+
+// Capabilities describes what an adapter supports, the bridge picks its
+// strategies accordingly.
+type Capabilities struct {
+	// TTL means services expire unless they are refreshed, otherwise
+	// Refresh is not called.
+	TTL bool
+	// Maintenance means the adapter implements MaintenanceAdapter, services
+	// are deregistered instead where it is missing.
+	Maintenance bool
+	// Status means the adapter implements StatusAdapter.
+	Status bool
+	// Batch means the adapter implements BatchAdapter, Sync and Reconcile
+	// group their registrations and deregistrations.
+	Batch bool
+	// Agent means the backend keeps a record of the agent that Heartbeat
+	// keeps alive.
+	Agent bool
+}
+
+// CapabilitiesAdapter is implemented by adapters that report what they
+// support. Adapters that do not are assumed to need refreshing and to
+// support what they implement.
+type CapabilitiesAdapter interface {
+	Capabilities() Capabilities
+}
+
+// adapterCapabilities returns the capabilities of an adapter, limited to the
+// optional interfaces it implements.
+func adapterCapabilities(adapter RegistryAdapterV2) Capabilities {
+	_, maintenance := adapter.(MaintenanceAdapter)
+	_, status := adapter.(StatusAdapter)
+	_, batch := adapter.(BatchAdapter)
+	caps := Capabilities{TTL: true, Maintenance: true, Status: true, Batch: true, Agent: true}
+	if c, ok := adapter.(CapabilitiesAdapter); ok {
+		caps = c.Capabilities()
+	}
+	caps.Maintenance = caps.Maintenance && maintenance
+	caps.Status = caps.Status && status
+	caps.Batch = caps.Batch && batch
+	return caps
+}
+
+// maintenanceAdapter returns the adapter if it supports maintenance, nil
+// otherwise.
+func (b *Bridge) maintenanceAdapter() MaintenanceAdapter {
+	if !b.caps.Maintenance {
+		return nil
+	}
+	return b.registry.(MaintenanceAdapter)
+}
+
+// statusAdapter returns the adapter if it supports a status, nil otherwise.
+func (b *Bridge) statusAdapter() StatusAdapter {
+	if !b.caps.Status {
+		return nil
+	}
+	return b.registry.(StatusAdapter)
+}
+
+// reportUnsupported logs the settings the adapter cannot honour and what
+// the bridge does instead.
+func (b *Bridge) reportUnsupported(config Config) {
+	log := utils.G(b.ctx)
+	if config.RefreshTtl > 0 && !b.caps.TTL {
+		log.WithField("ttl", config.RefreshTtl).Warn("adapter does not support TTLs, services are not refreshed and do not expire")
+	}
+	if config.PausePolicy == PauseMaintenance && !b.caps.Maintenance {
+		log.WithField("policy", config.PausePolicy).Warn("adapter does not support maintenance, deregistering services of paused containers instead")
+	}
+	if config.FlapThreshold > 0 && config.FlapPolicy == FlapCritical && !b.caps.Status {
+		log.WithField("policy", config.FlapPolicy).Warn("adapter does not support a status, suppressing services of flapping containers instead")
+	}
+	if config.OOMWarning > 0 && !b.caps.Status {
+		log.WithField("oom-warning", config.OOMWarning).Warn("adapter does not support a status, OOM kills are only logged")
+	}
+}
@@ -0,0 +1,86 @@
+package bridge
+
+import (
+	"regexp"
+	"registrator-containerd/pkg/metrics"
+	"registrator-containerd/utils"
+	"time"
+)
+
+// removeDangling deregisters the dangling services found by a cleanup pass
+// within the safety rails of the configuration: protected services are
+// kept, a service is only removed once it was dangling in consecutive
+// passes for the grace period, a pass removes at most CleanupMax services
+// and is aborted when more than CleanupAbort percent of the listed services
+// would be removed. A dry run logs every service it would remove before the
+// abort and the limit are applied, and removes nothing. It must be called
+// with the lock held.
+func (b *Bridge) removeDangling(dangling []*Service, listed int) {
+	log := utils.G(b.ctx)
+	protect, err := regexp.Compile(b.config.CleanupProtect)
+	if err != nil {
+		log.WithError(err).Error("cleanup aborted: bad protected pattern")
+		return
+	}
+	grace := time.Duration(b.config.CleanupGrace) * time.Second
+
+	now := time.Now()
+	since := make(map[string]time.Time)
+	var remove []*Service
+	for _, service := range dangling {
+		if b.config.CleanupProtect != "" && (protect.MatchString(service.Name) || protect.MatchString(service.ID)) {
+			b.serviceLog(service).Info("dangling but protected")
+			metrics.CleanupServices.WithLabelValues("protected").Inc()
+			continue
+		}
+		first, seen := b.danglingSince[service.ID]
+		if !seen {
+			first = now
+		}
+		since[service.ID] = first
+		if grace > 0 && (!seen || now.Sub(first) < grace) {
+			b.serviceLog(service).WithField("since", first.Format(time.RFC3339)).Info("dangling, removed after the grace period")
+			metrics.CleanupServices.WithLabelValues("deferred").Inc()
+			continue
+		}
+		remove = append(remove, service)
+	}
+	// services that are no longer dangling start over
+	b.danglingSince = since
+
+	if b.config.CleanupDryRun {
+		for _, service := range remove {
+			b.serviceLog(service).Info("dry run: would remove")
+			metrics.CleanupServices.WithLabelValues("dry_run").Inc()
+		}
+	}
+
+	if b.config.CleanupAbort > 0 && len(remove)*100 > b.config.CleanupAbort*listed {
+		log.WithFields(utils.Fields{
+			"dangling": len(remove),
+			"services": listed,
+			"percent":  b.config.CleanupAbort,
+		}).Warn("cleanup aborted: too many dangling services")
+		metrics.CleanupServices.WithLabelValues("aborted").Add(float64(len(remove)))
+		return
+	}
+	if limit := b.config.CleanupMax; limit > 0 && len(remove) > limit {
+		log.WithField("max", limit).WithField("remaining", len(remove)-limit).Warn("cleanup limit reached, removing the remaining services in the next pass")
+		metrics.CleanupServices.WithLabelValues("limited").Add(float64(len(remove) - limit))
+		remove = remove[:limit]
+	}
+	if b.config.CleanupDryRun {
+		return
+	}
+
+	for _, service := range remove {
+		err := b.deregister(service)
+		if err != nil {
+			b.serviceLog(service).WithError(err).Error("deregister failed")
+			continue
+		}
+		delete(b.danglingSince, service.ID)
+		b.serviceLog(service).Info("removed")
+		metrics.CleanupServices.WithLabelValues("removed").Inc()
+	}
+}
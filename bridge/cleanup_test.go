@@ -0,0 +1,99 @@
+package bridge
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"reflect"
+	"registrator-containerd/pkg/ctrclient"
+	"registrator-containerd/pkg/metrics"
+	"testing"
+)
+
+func cleanupServices(action string) prometheus.Counter {
+	return metrics.CleanupServices.WithLabelValues(action)
+}
+
+// putDangling adds services of the instance to the backend that no
+// container accounts for.
+func putDangling(adapter *FakeAdapter, names ...string) {
+	for _, name := range names {
+		adapter.Put(&Service{ID: name, Name: name, Attrs: map[string]string{AttrInstance: Hostname}})
+	}
+}
+
+func TestCleanupDryRunListsServicesBeforeAborting(t *testing.T) {
+	b, source, adapter := newTestBridge(t, Config{CleanupDryRun: true, CleanupAbort: 50})
+	b.Add(putPod(t, source, "web", 80))
+	putDangling(adapter, "a", "b", "c")
+	adapter.Calls()
+	listed := counterValue(t, cleanupServices("dry_run"))
+	aborted := counterValue(t, cleanupServices("aborted"))
+
+	if err := b.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertCalls(t, adapter, "services:fake-agent-1")
+	if got := counterValue(t, cleanupServices("dry_run")) - listed; got != 3 {
+		t.Fatalf("listed = %v, want 3", got)
+	}
+	if got := counterValue(t, cleanupServices("aborted")) - aborted; got != 3 {
+		t.Fatalf("aborted = %v, want 3", got)
+	}
+}
+
+func TestCleanupRemovesAtMostCleanupMaxPerPass(t *testing.T) {
+	b, _, adapter := newTestBridge(t, Config{CleanupMax: 2})
+	putDangling(adapter, "a", "b", "c")
+
+	if err := b.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if got := adapter.Registered(); len(got) != 1 {
+		t.Fatalf("registered = %q, want one left", got)
+	}
+	if err := b.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if got := adapter.Registered(); len(got) != 0 {
+		t.Fatalf("registered = %q", got)
+	}
+}
+
+func TestCleanupKeepsProtectedAndRecentServices(t *testing.T) {
+	b, _, adapter := newTestBridge(t, Config{CleanupProtect: "^vault$", CleanupGrace: 600})
+	putDangling(adapter, "vault", "old")
+
+	if err := b.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := adapter.Registered(), []string{"old", "vault"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("registered = %q, want %q", got, want)
+	}
+}
+
+func TestCleanupRemovesTheGeneratedIDOfAContainerWithServiceID(t *testing.T) {
+	b, source, adapter := newTestBridge(t, Config{})
+	container := NewFakeContainer(t, FakeContainer{
+		ID:        "k8s.io/web",
+		Name:      "web",
+		Namespace: ctrclient.K8sNamespace,
+		PodUID:    "uid-web",
+		IP:        "10.0.0.2",
+		Ports:     []ctrclient.PortMapping{{ContainerPort: 80, Protocol: "TCP"}},
+		Env:       map[string]string{"SERVICE_NAME": "web", "SERVICE_ID": "web-primary"},
+	})
+	source.Put(container, StateRunning)
+	b.Add(container.ID)
+	b.Add(putPod(t, source, "api", 80))
+	// registered before the upgrade, without ownership attrs, under the
+	// generated IDs
+	adapter.Put(&Service{ID: serviceId("web", 80), Name: "web"})
+	adapter.Put(&Service{ID: serviceId("api", 80), Name: "api"})
+
+	if err := b.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := adapter.Registered(), []string{serviceId("api", 80), "web-primary"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("registered = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,409 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/containerd/containerd"
+	apievents "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/events"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/typeurl/v2"
+	"registrator-containerd/pkg/ctrclient"
+	"registrator-containerd/utils"
+	"sort"
+	"strings"
+)
+
+// ContainerdSource reads containers from containerd, using the metadata the
+// CRI plugin attaches to Kubernetes containers and sandboxes. Other
+// containers, e.g. started by nerdctl, are read from their labels, OCI spec
+// and CNI results.
+//
+// Container IDs are only unique within a namespace, so the IDs returned by
+// List and Events are qualified as "namespace/id". Inspect and Status reject
+// unqualified IDs, the bridge would track the container twice otherwise.
+type ContainerdSource struct {
+	client *containerd.Client
+	// namespaces are the watched namespaces, all of them when nil
+	namespaces []string
+	// CNIResultsDir is the libcni cache the network attachments of
+	// containers are read from.
+	CNIResultsDir string
+}
+
+// NewContainerdSource watches the given namespaces, all namespaces when the
+// list is empty or contains "*".
+func NewContainerdSource(client *containerd.Client, namespaceList []string) *ContainerdSource {
+	s := &ContainerdSource{client: client, CNIResultsDir: ctrclient.DefaultCNIResultsDir}
+	for _, namespace := range namespaceList {
+		if namespace == "*" {
+			return s
+		}
+	}
+	s.namespaces = namespaceList
+	return s
+}
+
+// Namespaces returns the watched namespaces, discovering them through the
+// namespaces service when all namespaces are watched.
+func (s *ContainerdSource) Namespaces(ctx context.Context) ([]string, error) {
+	if s.namespaces != nil {
+		return s.namespaces, nil
+	}
+	return s.client.NamespaceService().List(ctx)
+}
+
+func (s *ContainerdSource) watches(namespace string) bool {
+	if s.namespaces == nil {
+		return true
+	}
+	for _, name := range s.namespaces {
+		if name == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// namespaced splits a container ID into its namespace and the containerd ID
+// and returns a context for the namespace.
+func (s *ContainerdSource) namespaced(ctx context.Context, containerId string) (context.Context, string, error) {
+	namespace, id, ok := strings.Cut(containerId, "/")
+	if !ok || namespace == "" || id == "" {
+		return nil, "", fmt.Errorf("container %q is not qualified as namespace/id: %w", containerId, errdefs.ErrInvalidArgument)
+	}
+	return namespaces.WithNamespace(ctx, namespace), id, nil
+}
+
+func qualifiedID(namespace string, containerId string) string {
+	return namespace + "/" + containerId
+}
+
+func (s *ContainerdSource) Ping(ctx context.Context) error {
+	serving, err := s.client.IsServing(ctx)
+	if err != nil {
+		return err
+	}
+	if !serving {
+		return errors.New("containerd is not serving")
+	}
+	return nil
+}
+
+func (s *ContainerdSource) Version(ctx context.Context) (string, error) {
+	version, err := s.client.Version(ctx)
+	if err != nil {
+		return "", err
+	}
+	return "containerd " + version.Version, nil
+}
+
+func (s *ContainerdSource) List(ctx context.Context) ([]string, error) {
+	namespaceList, err := s.Namespaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, namespace := range namespaceList {
+		containerList, err := s.client.Containers(namespaces.WithNamespace(ctx, namespace))
+		if err != nil {
+			return nil, err
+		}
+		for _, container := range containerList {
+			ids = append(ids, qualifiedID(namespace, container.ID()))
+		}
+	}
+	return ids, nil
+}
+
+func (s *ContainerdSource) Status(ctx context.Context, containerId string) (ContainerState, error) {
+	ctx, id, err := s.namespaced(ctx, containerId)
+	if err != nil {
+		return StateUnknown, err
+	}
+	status, err := ctrclient.GetContainerStatus(ctx, s.client, id)
+	if err != nil {
+		return StateUnknown, err
+	}
+	switch status.Status {
+	case containerd.Created:
+		return StateCreated, nil
+	case containerd.Running:
+		return StateRunning, nil
+	case containerd.Paused, containerd.Pausing:
+		return StatePaused, nil
+	case containerd.Stopped:
+		return StateStopped, nil
+	}
+	return StateUnknown, nil
+}
+
+func (s *ContainerdSource) Inspect(ctx context.Context, containerId string) (*K8SScheduleContainer, error) {
+	ctx, id, err := s.namespaced(ctx, containerId)
+	if err != nil {
+		return nil, err
+	}
+
+	container, err := s.client.ContainerService().Get(ctx, id)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("get container info failed %s", containerId), err)
+	}
+
+	podId := container.Labels[ctrclient.PodUid]
+	if podId == "" {
+		return s.inspectStandalone(ctx, containerId, container)
+	}
+
+	kind := container.Labels[ctrclient.ContainerType]
+	if kind != "container" {
+		return nil, nil
+	}
+
+	containerMetaData := container.Extensions[ctrclient.K8sLabelsContainerMetadata]
+	if containerMetaData == nil || containerMetaData.GetValue() == nil {
+		return nil, nil
+	}
+	var containerMeta ctrclient.ContainerMetadata
+	err = containerMeta.Unmarshal(containerMetaData)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("unmarshal ContainerMetadata error %s", containerId), err)
+	}
+
+	sandboxId := containerMeta.Metadata.SandBoxID
+
+	sandboxContainerInfo, err := s.client.ContainerService().Get(ctx, sandboxId)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("get container sandbox failed %s", sandboxId), err)
+	}
+
+	return s.inspectPod(ctx, containerId, container, containerMeta, sandboxContainerInfo)
+}
+
+// inspectPod builds a Kubernetes container from the containerd records of
+// the container and its sandbox. containerId is the qualified ID the bridge
+// tracks the container by. Without CNI results the services are registered
+// on the sandbox IP.
+func (s *ContainerdSource) inspectPod(ctx context.Context, containerId string, container containers.Container, containerMeta ctrclient.ContainerMetadata, sandboxContainerInfo containers.Container) (*K8SScheduleContainer, error) {
+	namespace, _, _ := strings.Cut(containerId, "/")
+	sandboxId := sandboxContainerInfo.ID
+
+	sandBoxMetaData := sandboxContainerInfo.Extensions[ctrclient.K8sLabelsSandboxMetadata]
+
+	var sandboxMeta ctrclient.ContainerMetadata
+	err := sandboxMeta.Unmarshal(sandBoxMetaData)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("unmarshal SandboxMetadata failed %s", sandboxId), err)
+	}
+
+	var containerSpec ctrclient.ContainerSpec
+	err = containerSpec.Unmarshal(container.Spec)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("unmarshal containerSpec failed %s", containerId), err)
+	}
+
+	networks, err := ctrclient.ReadCNIResults(s.CNIResultsDir, sandboxId)
+	if err != nil {
+		utils.G(ctx).WithError(err).WithField("container", containerId).Warn("read cni results failed, using the sandbox ip")
+	}
+
+	var k8sContainer K8SScheduleContainer
+	k8sContainer.ID = containerId
+	k8sContainer.Namespace = namespace
+	k8sContainer.Labels = container.Labels
+	k8sContainer.Container = &container
+	k8sContainer.ContainerMetadata = &containerMeta
+	k8sContainer.ContainerSpec = &containerSpec
+	k8sContainer.SandBoxContainer = &sandboxContainerInfo
+	k8sContainer.SandBoxMetadata = &sandboxMeta
+	k8sContainer.Networks = networks
+	k8sContainer.Name = k8sContainer.ContainerMetadata.Metadata.Name
+
+	return &k8sContainer, nil
+}
+
+// inspectStandalone builds a container that is not managed by Kubernetes.
+// The published ports come from the nerdctl/ports label and the IPs from the
+// nerdctl/ip labels or the CNI results of its networks. There is no sandbox,
+// SandBoxMetadata only carries the IPs of the container. containerId is the
+// qualified ID, the metadata and the CNI results use the containerd ID.
+func (s *ContainerdSource) inspectStandalone(ctx context.Context, containerId string, container containers.Container) (*K8SScheduleContainer, error) {
+	namespace, _, _ := strings.Cut(containerId, "/")
+	var containerSpec ctrclient.ContainerSpec
+	err := containerSpec.Unmarshal(container.Spec)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("unmarshal containerSpec failed %s", container.ID), err)
+	}
+
+	name := container.Labels[ctrclient.NerdctlName]
+	if name == "" {
+		name = container.ID
+	}
+	hostname := container.Labels[ctrclient.NerdctlHostname]
+	if hostname == "" {
+		hostname = containerSpec.GetEnv("HOSTNAME")
+	}
+
+	var containerMeta ctrclient.ContainerMetadata
+	containerMeta.Metadata.ID = container.ID
+	containerMeta.Metadata.Name = name
+	containerMeta.Metadata.Config.HostName = hostname
+	containerMeta.Metadata.Config.Labels = container.Labels
+	for _, env := range containerSpec.Process.Env {
+		key, value, _ := strings.Cut(env, "=")
+		containerMeta.AddEnv(key, value)
+	}
+	if portsJSON := container.Labels[ctrclient.NerdctlPorts]; portsJSON != "" {
+		var portMappings []ctrclient.PortMapping
+		if err := json.Unmarshal([]byte(portsJSON), &portMappings); err != nil {
+			return nil, errors.Join(fmt.Errorf("unmarshal %s label failed %s", ctrclient.NerdctlPorts, container.ID), err)
+		}
+		if err := containerMeta.SetPortMapping(portMappings); err != nil {
+			return nil, err
+		}
+	}
+
+	networks, ips, err := s.standaloneNetworks(ctx, containerId, container)
+	if err != nil {
+		return nil, err
+	}
+	var sandboxMeta ctrclient.ContainerMetadata
+	sandboxMeta.Metadata.ID = container.ID
+	if len(ips) > 0 {
+		sandboxMeta.Metadata.IP = ips[0]
+		sandboxMeta.Metadata.AdditionalIPs = ips[1:]
+	}
+
+	return &K8SScheduleContainer{
+		ID:                containerId,
+		Namespace:         namespace,
+		Name:              name,
+		Labels:            container.Labels,
+		Container:         &container,
+		ContainerMetadata: &containerMeta,
+		ContainerSpec:     &containerSpec,
+		SandBoxMetadata:   &sandboxMeta,
+		Networks:          networks,
+	}, nil
+}
+
+// standaloneNetworks returns the network attachments of the container in
+// the order of the nerdctl/networks label, followed by any other network,
+// and the IPs of the first one. The nerdctl/ip and nerdctl/ip6 labels take
+// precedence, they are the only IPs when the CNI results cannot be read.
+func (s *ContainerdSource) standaloneNetworks(ctx context.Context, containerId string, container containers.Container) ([]ctrclient.CNIResult, []string, error) {
+	results, err := ctrclient.ReadCNIResults(s.CNIResultsDir, container.ID)
+	if err != nil {
+		utils.G(ctx).WithError(err).WithField("container", containerId).Warn("read cni results failed, using the nerdctl ip labels")
+	}
+
+	var networks []string
+	if networksJSON := container.Labels[ctrclient.NerdctlNetworks]; networksJSON != "" {
+		if err := json.Unmarshal([]byte(networksJSON), &networks); err != nil {
+			return nil, nil, errors.Join(fmt.Errorf("unmarshal %s label failed %s", ctrclient.NerdctlNetworks, container.ID), err)
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return networkIndex(networks, results[i].Network) < networkIndex(networks, results[j].Network)
+	})
+
+	var ips []string
+	for _, label := range []string{ctrclient.NerdctlIP, ctrclient.NerdctlIP6} {
+		if ip := container.Labels[label]; ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) > 0 {
+		return results, ips, nil
+	}
+	for _, result := range results {
+		for _, ip := range result.IPs {
+			ips = append(ips, ip.String())
+		}
+		if len(ips) > 0 {
+			break
+		}
+	}
+	return results, ips, nil
+}
+
+func networkIndex(networks []string, network string) int {
+	for i, name := range networks {
+		if name == network {
+			return i
+		}
+	}
+	return len(networks)
+}
+
+func (s *ContainerdSource) Events(ctx context.Context) (<-chan *ContainerEvent, <-chan error) {
+	out := make(chan *ContainerEvent)
+	errs := make(chan error, 1)
+
+	eventsCh, errCh := s.client.EventService().Subscribe(ctx)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case e := <-eventsCh:
+				if e == nil || e.Event == nil || !s.watches(e.Namespace) {
+					continue
+				}
+				event, err := containerdEvent(e)
+				if err != nil {
+					utils.G(ctx).WithError(err).WithField("topic", e.Topic).Debug("cannot unmarshal an event from Any")
+					continue
+				}
+				select {
+				case out <- event:
+				case <-ctx.Done():
+					return
+				}
+			case err := <-errCh:
+				// the subscription is closed after the first error
+				errs <- err
+				return
+			}
+		}
+	}()
+	return out, errs
+}
+
+func containerdEvent(e *events.Envelope) (*ContainerEvent, error) {
+	v, err := typeurl.UnmarshalAny(e.Event)
+	if err != nil {
+		return nil, err
+	}
+
+	event := &ContainerEvent{
+		Type:      EventOther,
+		Topic:     e.Topic,
+		Namespace: e.Namespace,
+		Timestamp: e.Timestamp,
+		Payload:   v,
+	}
+	switch ev := v.(type) {
+	case *apievents.TaskStart:
+		event.Type = EventStart
+		event.ContainerID = qualifiedID(e.Namespace, ev.ContainerID)
+	case *apievents.TaskDelete:
+		event.Type = EventDelete
+		event.ContainerID = qualifiedID(e.Namespace, ev.ContainerID)
+	case *apievents.ContainerUpdate:
+		event.Type = EventUpdate
+		event.ContainerID = qualifiedID(e.Namespace, ev.ID)
+	case *apievents.TaskPaused:
+		event.Type = EventPause
+		event.ContainerID = qualifiedID(e.Namespace, ev.ContainerID)
+	case *apievents.TaskResumed:
+		event.Type = EventResume
+		event.ContainerID = qualifiedID(e.Namespace, ev.ContainerID)
+	case *apievents.TaskOOM:
+		event.Type = EventOOM
+		event.ContainerID = qualifiedID(e.Namespace, ev.ContainerID)
+	}
+	return event, nil
+}
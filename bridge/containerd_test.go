@@ -0,0 +1,275 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/typeurl/v2"
+	"os"
+	"path/filepath"
+	"reflect"
+	"registrator-containerd/pkg/ctrclient"
+	"testing"
+)
+
+// jsonAny is a containerd extension or spec holding JSON, the way the CRI
+// plugin stores its metadata.
+type jsonAny []byte
+
+func (a jsonAny) GetTypeUrl() string { return "" }
+func (a jsonAny) GetValue() []byte   { return a }
+
+func marshalAny(t *testing.T, v interface{}) jsonAny {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func testSpec(t *testing.T, env ...string) jsonAny {
+	var spec ctrclient.ContainerSpec
+	spec.Process.Env = env
+	return marshalAny(t, spec)
+}
+
+// podRecords returns the containerd records of a pod container, its
+// metadata and its sandbox.
+func podRecords(t *testing.T, id string, name string) (containers.Container, ctrclient.ContainerMetadata, containers.Container) {
+	t.Helper()
+	var containerMeta ctrclient.ContainerMetadata
+	containerMeta.Metadata.ID = id
+	containerMeta.Metadata.Name = name
+	containerMeta.Metadata.SandBoxID = "sandbox-" + id
+	containerMeta.AddEnv("SERVICE_NAME", name)
+	if err := containerMeta.SetPortMapping([]ctrclient.PortMapping{{ContainerPort: 80, Protocol: "TCP"}}); err != nil {
+		t.Fatal(err)
+	}
+	var sandboxMeta ctrclient.ContainerMetadata
+	sandboxMeta.Metadata.ID = "sandbox-" + id
+	sandboxMeta.Metadata.IP = "10.0.0.2"
+
+	container := containers.Container{
+		ID: id,
+		Labels: map[string]string{
+			ctrclient.PodUid:        "uid-" + name,
+			ctrclient.PodName:       name,
+			ctrclient.PodNamespace:  "default",
+			ctrclient.ContainerType: "container",
+		},
+		Spec:       testSpec(t, "SERVICE_NAME="+name),
+		Extensions: map[string]typeurl.Any{ctrclient.K8sLabelsContainerMetadata: marshalAny(t, containerMeta)},
+	}
+	sandbox := containers.Container{
+		ID:         "sandbox-" + id,
+		Extensions: map[string]typeurl.Any{ctrclient.K8sLabelsSandboxMetadata: marshalAny(t, sandboxMeta)},
+	}
+	return container, containerMeta, sandbox
+}
+
+func TestNamespacedRejectsUnqualifiedIDs(t *testing.T) {
+	s := &ContainerdSource{namespaces: []string{"k8s.io"}}
+
+	for _, containerId := range []string{"web", "/web", "k8s.io/"} {
+		if _, _, err := s.namespaced(context.Background(), containerId); !errdefs.IsInvalidArgument(err) {
+			t.Fatalf("namespaced(%q) err = %v, want invalid argument", containerId, err)
+		}
+	}
+
+	ctx, id, err := s.namespaced(context.Background(), "default/web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if namespace, _ := namespaces.Namespace(ctx); namespace != "default" || id != "web" {
+		t.Fatalf("namespace = %q, id = %q", namespace, id)
+	}
+}
+
+func TestInspectKeepsTheQualifiedID(t *testing.T) {
+	s := &ContainerdSource{CNIResultsDir: t.TempDir()}
+	container, containerMeta, sandbox := podRecords(t, "c1", "web")
+
+	pod, err := s.inspectPod(context.Background(), "k8s.io/c1", container, containerMeta, sandbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pod.ID != "k8s.io/c1" || pod.Namespace != "k8s.io" || pod.SandBoxMetadata.Metadata.ID != "sandbox-c1" {
+		t.Fatalf("pod container = %+v", pod)
+	}
+
+	standalone, err := s.inspectStandalone(context.Background(), "default/c2", containers.Container{ID: "c2", Spec: testSpec(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if standalone.ID != "default/c2" || standalone.Namespace != "default" || standalone.ContainerMetadata.Metadata.ID != "c2" {
+		t.Fatalf("standalone container = %+v", standalone)
+	}
+
+	// the bridge tracks and labels the services by the qualified ID
+	b, source, _ := newTestBridge(t, Config{})
+	source.Put(pod, StateRunning)
+	b.Add(pod.ID)
+	services := b.Services()["k8s.io/c1"]
+	if len(services) != 1 {
+		t.Fatalf("services = %v", b.Services())
+	}
+	if got := services[0].Origin.ContainerID; got != "k8s.io/c1" {
+		t.Fatalf("origin container = %q", got)
+	}
+	if got := services[0].Attrs[AttrContainer]; got != "k8s.io/c1" {
+		t.Fatalf("%s = %q", AttrContainer, got)
+	}
+}
+
+func TestInspectFallsBackToTheSandboxIPWithoutCNIResults(t *testing.T) {
+	// a cache entry that cannot be read
+	dir := t.TempDir()
+	for _, entry := range []string{"bridge-sandbox-c1-eth0", "bridge-default-c2-eth0"} {
+		if err := os.Mkdir(filepath.Join(dir, entry), 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &ContainerdSource{CNIResultsDir: dir}
+	container, containerMeta, sandbox := podRecords(t, "c1", "web")
+
+	pod, err := s.inspectPod(context.Background(), "k8s.io/c1", container, containerMeta, sandbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pod.Networks != nil || pod.SandBoxMetadata.Metadata.IP != "10.0.0.2" {
+		t.Fatalf("networks = %v, ip = %q", pod.Networks, pod.SandBoxMetadata.Metadata.IP)
+	}
+
+	standalone, err := s.inspectStandalone(context.Background(), "default/c2", containers.Container{
+		ID:     "c2",
+		Labels: map[string]string{ctrclient.NerdctlIP: "10.4.0.2"},
+		Spec:   testSpec(t),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if standalone.Networks != nil || standalone.SandBoxMetadata.Metadata.IP != "10.4.0.2" {
+		t.Fatalf("networks = %v, ip = %q", standalone.Networks, standalone.SandBoxMetadata.Metadata.IP)
+	}
+}
+
+// writeCNIResult adds a cache entry of a network attachment to dir.
+func writeCNIResult(t *testing.T, dir string, network string, containerId string, ifName string, address string) {
+	t.Helper()
+	entry := map[string]interface{}{
+		"containerId": containerId,
+		"ifName":      ifName,
+		"networkName": network,
+		"result":      map[string]interface{}{"ips": []map[string]string{{"address": address}}},
+	}
+	path := filepath.Join(dir, network+"-"+containerId+"-"+ifName)
+	if err := os.WriteFile(path, marshalAny(t, entry), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInspectStandaloneReadsTheNerdctlLabels(t *testing.T) {
+	s := &ContainerdSource{CNIResultsDir: t.TempDir()}
+	container, err := s.inspectStandalone(context.Background(), "default/c1", containers.Container{
+		ID: "c1",
+		Labels: map[string]string{
+			ctrclient.NerdctlName:     "web",
+			ctrclient.NerdctlHostname: "web-host",
+			ctrclient.NerdctlPorts:    `[{"hostPort":8080,"hostIP":"0.0.0.0","containerPort":80,"protocol":"tcp"}]`,
+			ctrclient.NerdctlIP:       "10.4.0.2",
+			"SERVICE_TAGS":            "blue",
+		},
+		Spec: testSpec(t, "SERVICE_NAME=web", "HOSTNAME=ignored"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if container.Name != "web" || container.ContainerMetadata.Metadata.Config.HostName != "web-host" {
+		t.Fatalf("name = %q, hostname = %q", container.Name, container.ContainerMetadata.Metadata.Config.HostName)
+	}
+	ports, err := container.ContainerMetadata.GetPortMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []ctrclient.PortMapping{{HostPort: 8080, HostIP: "0.0.0.0", ContainerPort: 80, Protocol: "tcp"}}; !reflect.DeepEqual(ports, want) {
+		t.Fatalf("ports = %+v, want %+v", ports, want)
+	}
+
+	// published on the host with -ip, the container IP with -internal
+	for _, test := range []struct {
+		internal bool
+		ip       string
+		port     int
+	}{
+		{false, "192.168.0.10", 8080},
+		{true, "10.4.0.2", 80},
+	} {
+		b, source, _ := newTestBridge(t, Config{HostIp: "192.168.0.10", Internal: test.internal})
+		source.Put(container, StateRunning)
+		b.Add(container.ID)
+		services := b.Services()[container.ID]
+		if len(services) != 1 {
+			t.Fatalf("services = %v", b.Services())
+		}
+		service := services[0]
+		if want := Hostname + ":default:web:80"; service.ID != want || service.Name != "web" {
+			t.Fatalf("service id = %q, name = %q, want %q", service.ID, service.Name, want)
+		}
+		if service.IP != test.ip || service.Port != test.port || !reflect.DeepEqual(service.Tags, []string{"blue"}) {
+			t.Fatalf("internal %v: service = %s:%d %q", test.internal, service.IP, service.Port, service.Tags)
+		}
+	}
+
+	// a label that is not a list of port mappings fails the inspection
+	_, err = s.inspectStandalone(context.Background(), "default/c2", containers.Container{
+		ID:     "c2",
+		Labels: map[string]string{ctrclient.NerdctlPorts: `{"containerPort":80}`},
+		Spec:   testSpec(t),
+	})
+	if err == nil {
+		t.Fatal("inspected a container with a bad ports label")
+	}
+}
+
+func TestInspectStandaloneOrdersNetworksByTheNerdctlLabel(t *testing.T) {
+	dir := t.TempDir()
+	writeCNIResult(t, dir, "bridge", "default-c1", "eth0", "10.4.0.2/24")
+	writeCNIResult(t, dir, "storage", "default-c1", "eth1", "10.5.0.2/24")
+	writeCNIResult(t, dir, "extra", "default-c1", "eth2", "10.6.0.2/24")
+	s := &ContainerdSource{CNIResultsDir: dir}
+	labels := map[string]string{ctrclient.NerdctlNetworks: `["storage","bridge"]`}
+
+	container, err := s.inspectStandalone(context.Background(), "default/c1", containers.Container{ID: "c1", Labels: labels, Spec: testSpec(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var networks []string
+	for _, network := range container.Networks {
+		networks = append(networks, network.Network)
+	}
+	if want := []string{"storage", "bridge", "extra"}; !reflect.DeepEqual(networks, want) {
+		t.Fatalf("networks = %q, want %q", networks, want)
+	}
+	if ip := container.SandBoxMetadata.Metadata.IP; ip != "10.5.0.2" {
+		t.Fatalf("ip = %q, want the address on the first network", ip)
+	}
+
+	// the ip labels take precedence
+	labels[ctrclient.NerdctlIP] = "10.4.0.2"
+	labels[ctrclient.NerdctlIP6] = "fd00::2"
+	container, err = s.inspectStandalone(context.Background(), "default/c1", containers.Container{ID: "c1", Labels: labels, Spec: testSpec(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata := container.SandBoxMetadata.Metadata; metadata.IP != "10.4.0.2" || !reflect.DeepEqual(metadata.AdditionalIPs, []string{"fd00::2"}) {
+		t.Fatalf("ips = %q %q", metadata.IP, metadata.AdditionalIPs)
+	}
+
+	labels[ctrclient.NerdctlNetworks] = "storage"
+	if _, err := s.inspectStandalone(context.Background(), "default/c1", containers.Container{ID: "c1", Labels: labels, Spec: testSpec(t)}); err == nil {
+		t.Fatal("inspected a container with a bad networks label")
+	}
+}
@@ -0,0 +1,411 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"github.com/containerd/errdefs"
+	"net/url"
+	"registrator-containerd/pkg/ctrclient"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// FakeSource is an in-memory ContainerSource. Together with FakeAdapter it
+// allows Add, Remove, Sync and cleanup to be exercised without a container
+// runtime or a registry backend.
+type FakeSource struct {
+	sync.Mutex
+	containers map[string]*K8SScheduleContainer
+	states     map[string]ContainerState
+	events     chan *ContainerEvent
+	errs       chan error
+	// Err is returned by every call when set.
+	Err error
+}
+
+func NewFakeSource() *FakeSource {
+	return &FakeSource{
+		containers: make(map[string]*K8SScheduleContainer),
+		states:     make(map[string]ContainerState),
+		events:     make(chan *ContainerEvent),
+		errs:       make(chan error, 1),
+	}
+}
+
+// Emit delivers an event to the consumer of Events, it blocks until the
+// event is received.
+func (f *FakeSource) Emit(event *ContainerEvent) {
+	f.events <- event
+}
+
+// Fail ends the event stream with err.
+func (f *FakeSource) Fail(err error) {
+	f.errs <- err
+}
+
+func (f *FakeSource) Events(ctx context.Context) (<-chan *ContainerEvent, <-chan error) {
+	return f.events, f.errs
+}
+
+// Put adds or replaces a container.
+func (f *FakeSource) Put(container *K8SScheduleContainer, state ContainerState) {
+	f.Lock()
+	defer f.Unlock()
+	f.containers[container.ID] = container
+	f.states[container.ID] = state
+}
+
+func (f *FakeSource) SetState(containerId string, state ContainerState) {
+	f.Lock()
+	defer f.Unlock()
+	f.states[containerId] = state
+}
+
+func (f *FakeSource) Delete(containerId string) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.containers, containerId)
+	delete(f.states, containerId)
+}
+
+func (f *FakeSource) Ping(ctx context.Context) error {
+	f.Lock()
+	defer f.Unlock()
+	return f.Err
+}
+
+func (f *FakeSource) Version(ctx context.Context) (string, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.Err != nil {
+		return "", f.Err
+	}
+	return "fake 0.1.0", nil
+}
+
+func (f *FakeSource) List(ctx context.Context) ([]string, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	ids := make([]string, 0, len(f.containers))
+	for id := range f.containers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (f *FakeSource) Inspect(ctx context.Context, containerId string) (*K8SScheduleContainer, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	container, ok := f.containers[containerId]
+	if !ok {
+		return nil, fmt.Errorf("container %q: %w", containerId, errdefs.ErrNotFound)
+	}
+	return container, nil
+}
+
+func (f *FakeSource) Status(ctx context.Context, containerId string) (ContainerState, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.Err != nil {
+		return StateUnknown, f.Err
+	}
+	state, ok := f.states[containerId]
+	if !ok {
+		return StateUnknown, fmt.Errorf("container %q: %w", containerId, errdefs.ErrNotFound)
+	}
+	return state, nil
+}
+
+// FakeContainer describes a Kubernetes container built by NewFakeContainer.
+type FakeContainer struct {
+	ID           string
+	Name         string
+	Namespace    string
+	PodUID       string
+	PodName      string
+	PodNamespace string
+	SandboxID    string
+	IP           string
+	Hostname     string
+	Ports        []ctrclient.PortMapping
+	Env          map[string]string
+	Networks     []ctrclient.CNIResult
+}
+
+// NewFakeContainer builds the container the way ContainerdSource.Inspect
+// does from the CRI metadata.
+func NewFakeContainer(t testing.TB, c FakeContainer) *K8SScheduleContainer {
+	t.Helper()
+	var containerMeta ctrclient.ContainerMetadata
+	containerMeta.Metadata.ID = c.ID
+	containerMeta.Metadata.Name = c.Name
+	containerMeta.Metadata.SandBoxID = c.SandboxID
+	containerMeta.Metadata.Config.HostName = c.Hostname
+	if err := containerMeta.SetPortMapping(c.Ports); err != nil {
+		t.Fatal(err)
+	}
+
+	var containerSpec ctrclient.ContainerSpec
+	keys := make([]string, 0, len(c.Env))
+	for key := range c.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		containerMeta.AddEnv(key, c.Env[key])
+		containerSpec.Process.Env = append(containerSpec.Process.Env, key+"="+c.Env[key])
+	}
+	if c.Hostname != "" {
+		containerSpec.Process.Env = append(containerSpec.Process.Env, "HOSTNAME="+c.Hostname)
+	}
+
+	var sandboxMeta ctrclient.ContainerMetadata
+	sandboxMeta.Metadata.ID = c.SandboxID
+	sandboxMeta.Metadata.IP = c.IP
+
+	return &K8SScheduleContainer{
+		ID:        c.ID,
+		Name:      c.Name,
+		Namespace: c.Namespace,
+		Labels: map[string]string{
+			ctrclient.PodUid:        c.PodUID,
+			ctrclient.PodName:       c.PodName,
+			ctrclient.PodNamespace:  c.PodNamespace,
+			ctrclient.ContainerName: c.Name,
+			ctrclient.ContainerType: "container",
+		},
+		ContainerMetadata: &containerMeta,
+		ContainerSpec:     &containerSpec,
+		SandBoxMetadata:   &sandboxMeta,
+		Networks:          c.Networks,
+	}
+}
+
+// FakeAdapter is an in-memory RegistryAdapterV2 that records every call.
+type FakeAdapter struct {
+	sync.Mutex
+	services map[string]*Service
+	// deregistered are copies of the deregistered services
+	deregistered []Service
+	calls        []string
+	agents       int
+	agentId      string
+	forgotten    bool
+	agent        Agent
+	// Err is returned by every call when set.
+	Err error
+}
+
+func NewFakeAdapter() *FakeAdapter {
+	return &FakeAdapter{services: make(map[string]*Service)}
+}
+
+// FakeFactory returns the same FakeAdapter for every URI. Register it with
+// Register(&FakeFactory{Adapter: adapter}, "fake") to use "fake://" URIs.
+type FakeFactory struct {
+	Adapter *FakeAdapter
+}
+
+func (f *FakeFactory) New(uri *url.URL) RegistryAdapter {
+	return AdapterV1(f.Adapter)
+}
+
+func (f *FakeFactory) NewV2(uri *url.URL) RegistryAdapterV2 {
+	return f.Adapter
+}
+
+func (f *FakeAdapter) record(call string) error {
+	f.calls = append(f.calls, call)
+	return f.Err
+}
+
+// RegisterAgentNode records "agent:<host ip>" and returns "fake-agent-<n>",
+// n counting the registrations.
+func (f *FakeAdapter) RegisterAgentNode(ctx context.Context, agent Agent) (string, error) {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.record("agent:" + agent.HostIp); err != nil {
+		return "", err
+	}
+	f.agents++
+	f.agentId = fmt.Sprintf("fake-agent-%d", f.agents)
+	f.agent = agent
+	return f.agentId, nil
+}
+
+// Ping returns ErrUnknownAgent for any agent but the last registered one
+// once ForgetAgent was called.
+func (f *FakeAdapter) Ping(ctx context.Context, agentId string) error {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.record("ping:" + agentId); err != nil {
+		return err
+	}
+	if f.forgotten && agentId != f.agentId {
+		return ErrUnknownAgent
+	}
+	return nil
+}
+
+// LastAgent returns the last registered agent.
+func (f *FakeAdapter) LastAgent() Agent {
+	f.Lock()
+	defer f.Unlock()
+	return f.agent
+}
+
+// ForgetAgent drops the record of the agent, as a backend that lost it.
+func (f *FakeAdapter) ForgetAgent() {
+	f.Lock()
+	defer f.Unlock()
+	f.forgotten = true
+	f.agentId = ""
+}
+
+// Register stores a copy of the service, as a backend keeps its own record.
+func (f *FakeAdapter) Register(ctx context.Context, service *Service) error {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.record("register:" + service.ID); err != nil {
+		return err
+	}
+	registered := *service
+	f.services[service.ID] = &registered
+	return nil
+}
+
+func (f *FakeAdapter) Update(ctx context.Context, service *Service) error {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.record("update:" + service.ID); err != nil {
+		return err
+	}
+	f.services[service.ID] = service
+	return nil
+}
+
+// RegisterBatch records "register-batch:<count>" and registers the
+// services.
+func (f *FakeAdapter) RegisterBatch(ctx context.Context, services []*Service) error {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.record(fmt.Sprintf("register-batch:%d", len(services))); err != nil {
+		return err
+	}
+	for _, service := range services {
+		f.services[service.ID] = service
+	}
+	return nil
+}
+
+// DeregisterBatch records "deregister-batch:<count>" and deregisters the
+// services.
+func (f *FakeAdapter) DeregisterBatch(ctx context.Context, services []*Service) error {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.record(fmt.Sprintf("deregister-batch:%d", len(services))); err != nil {
+		return err
+	}
+	for _, service := range services {
+		delete(f.services, service.ID)
+	}
+	return nil
+}
+
+func (f *FakeAdapter) Deregister(ctx context.Context, service *Service) error {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.record("deregister:" + service.ID); err != nil {
+		return err
+	}
+	f.deregistered = append(f.deregistered, *service)
+	delete(f.services, service.ID)
+	return nil
+}
+
+func (f *FakeAdapter) Refresh(ctx context.Context, service *Service) error {
+	f.Lock()
+	defer f.Unlock()
+	return f.record("refresh:" + service.ID)
+}
+
+func (f *FakeAdapter) Maintenance(ctx context.Context, service *Service, enable bool, reason string) error {
+	f.Lock()
+	defer f.Unlock()
+	if enable {
+		return f.record("maintenance:" + service.ID)
+	}
+	return f.record("ready:" + service.ID)
+}
+
+func (f *FakeAdapter) SetStatus(ctx context.Context, service *Service, status string, note string) error {
+	f.Lock()
+	defer f.Unlock()
+	return f.record(status + ":" + service.ID)
+}
+
+func (f *FakeAdapter) Services(ctx context.Context, agentId string) ([]*Service, error) {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.record("services:" + agentId); err != nil {
+		return nil, err
+	}
+	out := make([]*Service, 0, len(f.services))
+	for _, service := range f.services {
+		out = append(out, service)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+// Put stores a service as if it had been registered by someone else.
+func (f *FakeAdapter) Put(service *Service) {
+	f.Lock()
+	defer f.Unlock()
+	f.services[service.ID] = service
+}
+
+// Service returns the registered service with the ID, nil when there is
+// none.
+func (f *FakeAdapter) Service(id string) *Service {
+	f.Lock()
+	defer f.Unlock()
+	return f.services[id]
+}
+
+// Deregistered returns copies of the deregistered services.
+func (f *FakeAdapter) Deregistered() []Service {
+	f.Lock()
+	defer f.Unlock()
+	return append([]Service(nil), f.deregistered...)
+}
+
+// Registered returns the IDs of the registered services.
+func (f *FakeAdapter) Registered() []string {
+	f.Lock()
+	defer f.Unlock()
+	ids := make([]string, 0, len(f.services))
+	for id := range f.services {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Calls returns the recorded calls, e.g. "register:<service id>", and resets
+// the record.
+func (f *FakeAdapter) Calls() []string {
+	f.Lock()
+	defer f.Unlock()
+	calls := f.calls
+	f.calls = nil
+	return calls
+}
@@ -0,0 +1,211 @@
+package bridge
+
+import (
+	"fmt"
+	"registrator-containerd/pkg/metrics"
+	"time"
+)
+
+const (
+	// FlapSuppress does not register the services of a flapping container.
+	FlapSuppress = "suppress"
+	// FlapCritical registers the services of a flapping container with a
+	// critical status.
+	FlapCritical = "critical"
+)
+
+// ValidateFlapPolicy returns an error for an unknown -flap-policy value.
+func ValidateFlapPolicy(policy string) error {
+	switch policy {
+	case FlapSuppress, FlapCritical:
+		return nil
+	}
+	return fmt.Errorf("unknown flap policy %q, use %s or %s", policy, FlapSuppress, FlapCritical)
+}
+
+// flapState counts the starts of a container of a pod, or of a named
+// container outside Kubernetes, across the container IDs it is restarted
+// with.
+type flapState struct {
+	starts []time.Time
+	// up are the container IDs that started and were not removed since
+	up     map[string]bool
+	damped bool
+	// stable restores a damped container that stays up long enough
+	stable *time.Timer
+}
+
+// flapKey identifies a container across restarts.
+func flapKey(container *K8SScheduleContainer) string {
+	if container.Kubernetes() {
+		return container.PodName() + "/" + container.Name
+	}
+	return container.Namespace + "/" + container.Name
+}
+
+// flapPolicy returns the flap policy, FlapCritical falls back to
+// FlapSuppress when the adapter does not support a status.
+func (b *Bridge) flapPolicy() string {
+	if !b.caps.Status {
+		return FlapSuppress
+	}
+	return b.config.FlapPolicy
+}
+
+// flapping records the start of a container that was not up yet and reports
+// whether its services are damped, and whether the damping is new to the
+// container, i.e. it did not pass through here since it started. It must be
+// called with the lock held.
+func (b *Bridge) flapping(containerId string, services []*Service) (damped bool, started bool) {
+	if b.config.FlapThreshold <= 0 || len(services) == 0 {
+		return false, false
+	}
+	b.pruneFlaps()
+	key := flapKey(services[0].Origin.container)
+	state := b.flaps[key]
+	if state == nil {
+		state = &flapState{up: make(map[string]bool)}
+		b.flaps[key] = state
+	}
+	if state.up[containerId] {
+		return state.damped, false
+	}
+
+	state.up[containerId] = true
+	b.flapKeys[containerId] = key
+	now := time.Now()
+	state.starts = append(b.recentStarts(state.starts, now), now)
+	if !state.damped && len(state.starts) > b.config.FlapThreshold {
+		state.damped = true
+		b.containerLog(containerId).WithField("starts", len(state.starts)).Warnf("flapping: started %d times within %ds", len(state.starts), b.config.FlapWindow)
+	}
+	if state.damped {
+		b.startFlapStable(key, state)
+	}
+	return state.damped, state.damped
+}
+
+// damped reports whether the services of a container are damped. It must be
+// called with the lock held.
+func (b *Bridge) damped(containerId string) bool {
+	key, ok := b.flapKeys[containerId]
+	if !ok {
+		return false
+	}
+	state := b.flaps[key]
+	return state != nil && state.damped
+}
+
+// recentStarts drops the starts that left the flap window.
+func (b *Bridge) recentStarts(starts []time.Time, now time.Time) []time.Time {
+	since := now.Add(-time.Duration(b.config.FlapWindow) * time.Second)
+	for len(starts) > 0 && starts[0].Before(since) {
+		starts = starts[1:]
+	}
+	return starts
+}
+
+// dampServices counts the services of a container that started while it is
+// flapping. Suppressed services are not registered, critical ones are
+// reported critical once they are registered. It must be called with the
+// lock held.
+func (b *Bridge) dampServices(services []*Service) {
+	policy := b.flapPolicy()
+	for _, service := range services {
+		metrics.FlapDamped.WithLabelValues(policy).Inc()
+		if policy == FlapSuppress {
+			b.serviceLog(service).Info("suppressed: container is flapping")
+		}
+	}
+}
+
+// startFlapStable (re)starts the period a damped container has to stay up
+// before it is restored. It must be called with the lock held.
+func (b *Bridge) startFlapStable(key string, state *flapState) {
+	if state.stable != nil {
+		state.stable.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Duration(b.config.FlapStable)*time.Second, func() {
+		b.Lock()
+		defer b.Unlock()
+		defer b.updateGauges()
+		if state.stable != timer || b.flaps[key] != state {
+			return
+		}
+		b.flapRecovered(state)
+	})
+	state.stable = timer
+}
+
+// flapRecovered restores the services of a container that stopped flapping.
+// It must be called with the lock held.
+func (b *Bridge) flapRecovered(state *flapState) {
+	state.damped = false
+	state.starts = nil
+	state.stable = nil
+
+	adapter := b.statusAdapter()
+	for containerId := range state.up {
+		b.containerLog(containerId).Info("stable: no longer flapping")
+		services := b.services[containerId]
+		if services == nil {
+			b.add(containerId, false)
+			continue
+		}
+		if adapter == nil {
+			continue
+		}
+		for _, service := range services {
+			b.setStatus(adapter, service, HealthPassing, "")
+		}
+	}
+}
+
+// flapStopped records that a container went down, a damped container has
+// to stay up for the whole stable period again. It must be called with the
+// lock held.
+func (b *Bridge) flapStopped(containerId string) {
+	key, ok := b.flapKeys[containerId]
+	if !ok {
+		return
+	}
+	delete(b.flapKeys, containerId)
+	state := b.flaps[key]
+	if state == nil {
+		return
+	}
+	delete(state.up, containerId)
+	if len(state.up) > 0 {
+		return
+	}
+	if state.stable != nil {
+		state.stable.Stop()
+		state.stable = nil
+	}
+	b.pruneFlaps()
+}
+
+// pruneFlaps forgets the containers that are down and did not start within
+// the flap window, e.g. deleted pods. It must be called with the lock held.
+func (b *Bridge) pruneFlaps() {
+	now := time.Now()
+	for key, state := range b.flaps {
+		state.starts = b.recentStarts(state.starts, now)
+		if len(state.up) == 0 && len(state.starts) == 0 {
+			delete(b.flaps, key)
+		}
+	}
+}
+
+// flappingContainers returns the number of damped containers. It must be
+// called with the lock held.
+func (b *Bridge) flappingContainers() int {
+	count := 0
+	for _, state := range b.flaps {
+		if state.damped {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,79 @@
+package bridge
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"registrator-containerd/pkg/ctrclient"
+	"registrator-containerd/pkg/metrics"
+	"testing"
+)
+
+// restartPod replaces the container of a pod with a new one, like the
+// kubelet restarting a crashing container. The new container is added
+// unless the next Sync is left to find it.
+func restartPod(t *testing.T, b *Bridge, source *FakeSource, previous string, restart int, add bool) string {
+	t.Helper()
+	if previous != "" {
+		b.Remove(previous)
+		source.Delete(previous)
+	}
+	container := NewFakeContainer(t, FakeContainer{
+		ID:           fmt.Sprintf("k8s.io/web-%d", restart),
+		Name:         "web",
+		Namespace:    ctrclient.K8sNamespace,
+		PodUID:       "uid-web",
+		PodName:      "web",
+		PodNamespace: "default",
+		SandboxID:    "sandbox-web",
+		IP:           "10.0.0.2",
+		Ports:        []ctrclient.PortMapping{{ContainerPort: 80, Protocol: "TCP"}},
+		Env:          map[string]string{"SERVICE_NAME": "web"},
+	})
+	source.Put(container, StateRunning)
+	if add {
+		b.Add(container.ID)
+	}
+	return container.ID
+}
+
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := counter.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestFlappingContainerIsCountedOnce(t *testing.T) {
+	b, source, adapter := newTestBridge(t, Config{FlapThreshold: 1, FlapWindow: 60, FlapStable: 60, FlapPolicy: FlapSuppress})
+	id := restartPod(t, b, source, "", 1, true)
+	damped := metrics.FlapDamped.WithLabelValues(FlapSuppress)
+	before := counterValue(t, damped)
+
+	restartPod(t, b, source, id, 2, true)
+	b.Sync(false)
+	b.Sync(false)
+
+	if got := counterValue(t, damped) - before; got != 1 {
+		t.Fatalf("damped services = %v, want 1", got)
+	}
+	if len(b.Services()) != 0 || len(adapter.Registered()) != 0 {
+		t.Fatalf("services = %v, registered = %v", b.Services(), adapter.Registered())
+	}
+}
+
+func TestFlappingContainerIsReportedCriticalAfterTheBatch(t *testing.T) {
+	b, source, adapter := newTestBridge(t, Config{FlapThreshold: 1, FlapWindow: 60, FlapStable: 60, FlapPolicy: FlapCritical, BatchSize: 10})
+	id := restartPod(t, b, source, "", 1, true)
+	id = restartPod(t, b, source, id, 2, false)
+	adapter.Calls()
+
+	b.Sync(false)
+
+	assertCalls(t, adapter, "register-batch:1", HealthCritical+":"+serviceId("web", 80))
+	if len(b.Services()[id]) != 1 {
+		t.Fatalf("services = %v", b.Services())
+	}
+}
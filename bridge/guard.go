@@ -0,0 +1,353 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"registrator-containerd/pkg/metrics"
+	"registrator-containerd/utils"
+	"sync"
+	"time"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// maxQueuedAttempts is how often a queued operation the backend refuses is
+// tried before it is dropped, so that it cannot block the queue. Operations
+// that fail because the backend is down are kept until it answers.
+const maxQueuedAttempts = 5
+
+// ErrCircuitOpen is returned by operations that cannot be queued while the
+// backend is considered down.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+type queuedOp struct {
+	op       string
+	id       string
+	call     func() error
+	attempts int
+}
+
+// guard protects the backend with a token bucket rate limiter and a circuit
+// breaker. Operations on services are queued instead of waiting for a token
+// or failing while the circuit is open, and replayed in order by a single
+// goroutine once the backend answers again.
+type guard struct {
+	sync.Mutex
+	rate     float64
+	burst    int
+	failures int
+	cooldown time.Duration
+	scheme   string
+	ctx      context.Context
+	// dropped is called with the operations given up on after
+	// maxQueuedAttempts, without the lock held.
+	dropped func(op string, id string)
+
+	tokens float64
+	last   time.Time
+
+	state    string
+	failed   int
+	trial    bool
+	queue    []*queuedOp
+	draining bool
+}
+
+func newGuard(ctx context.Context, scheme string, config Config) *guard {
+	g := &guard{
+		rate:     config.RateLimit,
+		burst:    config.RateBurst,
+		failures: config.BreakerFailures,
+		cooldown: time.Duration(config.BreakerCooldown) * time.Second,
+		scheme:   scheme,
+		ctx:      ctx,
+		tokens:   float64(config.RateBurst),
+		last:     time.Now(),
+	}
+	g.setState(BreakerClosed)
+	return g
+}
+
+// do runs an operation on a service, or queues it while the circuit is open,
+// no token is left or older operations are still queued. Queued operations
+// return nil, callers never sleep, they may hold the bridge lock. Later
+// operations on the same service supersede queued ones where the outcome is
+// the same: a deregistration drops everything queued before it, a refresh is
+// dropped when anything is queued and repeated operations of the same kind
+// keep their place in the queue.
+func (g *guard) do(op string, id string, call func() error) error {
+	g.Lock()
+	if len(g.queue) > 0 || (g.failures > 0 && (g.state == BreakerOpen || g.trial)) || !g.take() {
+		g.enqueue(&queuedOp{op: op, id: id, call: call})
+		g.startDrain()
+		g.Unlock()
+		utils.G(g.ctx).WithField("service", id).WithField("operation", op).Debug("queued")
+		return nil
+	}
+	trial := g.state == BreakerHalfOpen
+	g.trial = trial
+	g.Unlock()
+
+	return g.run(call, trial)
+}
+
+// call runs an operation that needs its result, it fails while the circuit
+// is open. It is not delayed by the rate limit, its token delays the queued
+// operations instead.
+func (g *guard) call(call func() error) error {
+	return g.direct(call, false)
+}
+
+// batch runs an operation on several services. It also fails while
+// operations are queued, so that the services are queued one by one behind
+// them instead.
+func (g *guard) batch(call func() error) error {
+	return g.direct(call, true)
+}
+
+func (g *guard) direct(call func() error, behindQueue bool) error {
+	g.Lock()
+	if (behindQueue && len(g.queue) > 0) || (g.failures > 0 && (g.state == BreakerOpen || g.trial)) {
+		g.Unlock()
+		return ErrCircuitOpen
+	}
+	trial := g.state == BreakerHalfOpen
+	g.trial = trial
+	g.charge()
+	g.Unlock()
+
+	return g.run(call, trial)
+}
+
+func (g *guard) run(call func() error, trial bool) error {
+	err := call()
+
+	g.Lock()
+	defer g.Unlock()
+	g.record(err)
+	if trial {
+		// the next trial is up to the queue when the breaker is still
+		// half-open
+		g.trial = false
+		g.startDrain()
+	}
+	return err
+}
+
+// refill adds the tokens earned since the last call. It must be called with
+// the lock held.
+func (g *guard) refill() {
+	now := time.Now()
+	g.tokens += now.Sub(g.last).Seconds() * g.rate
+	if burst := float64(g.burst); g.tokens > burst {
+		g.tokens = burst
+	}
+	g.last = now
+}
+
+// take takes a token from the bucket when one is available. It must be
+// called with the lock held.
+func (g *guard) take() bool {
+	if g.rate <= 0 {
+		return true
+	}
+	g.refill()
+	if g.tokens < 1 {
+		return false
+	}
+	g.tokens--
+	return true
+}
+
+// charge takes a token from the bucket even when none is left. It must be
+// called with the lock held.
+func (g *guard) charge() {
+	if g.rate <= 0 {
+		return
+	}
+	g.refill()
+	g.tokens--
+}
+
+// wait takes a token from the bucket, sleeping until one is available. Only
+// the drain waits.
+func (g *guard) wait() {
+	if g.rate <= 0 {
+		return
+	}
+	g.Lock()
+	g.charge()
+	delay := time.Duration(-g.tokens / g.rate * float64(time.Second))
+	g.Unlock()
+
+	if delay <= 0 {
+		return
+	}
+	select {
+	case <-g.ctx.Done():
+	case <-time.After(delay):
+	}
+}
+
+// backendFailure reports whether an error means that the backend cannot be
+// reached or failed. Cancelled and refused operations and an unknown agent
+// do not.
+func backendFailure(err error) bool {
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, ErrRejected) && !errors.Is(err, ErrUnknownAgent)
+}
+
+// record updates the breaker with the result of an operation, errors that
+// are not failures of the backend are ignored. It must be called with the
+// lock held.
+func (g *guard) record(err error) {
+	if g.failures <= 0 || (err != nil && !backendFailure(err)) {
+		return
+	}
+	if err == nil {
+		g.failed = 0
+		if g.state != BreakerClosed {
+			g.setState(BreakerClosed)
+			g.startDrain()
+		}
+		return
+	}
+
+	g.failed++
+	if g.state == BreakerOpen || (g.state == BreakerClosed && g.failed < g.failures) {
+		return
+	}
+	g.setState(BreakerOpen)
+	time.AfterFunc(g.cooldown, func() {
+		g.Lock()
+		defer g.Unlock()
+		if g.state != BreakerOpen {
+			return
+		}
+		g.setState(BreakerHalfOpen)
+		g.startDrain()
+	})
+}
+
+// startDrain must be called with the lock held.
+func (g *guard) startDrain() {
+	if len(g.queue) > 0 && !g.draining && g.state != BreakerOpen {
+		g.draining = true
+		go g.drain()
+	}
+}
+
+// drain replays the queued operations, the first one probes the backend
+// while the circuit is half-open. An operation stays at the head of the
+// queue while it fails because the backend is down, the drain stops when
+// the breaker opens and starts again after the cooldown.
+func (g *guard) drain() {
+	for {
+		g.Lock()
+		if len(g.queue) == 0 || g.state == BreakerOpen || g.trial || g.ctx.Err() != nil {
+			g.draining = false
+			g.Unlock()
+			return
+		}
+		q := g.queue[0]
+		trial := g.state == BreakerHalfOpen
+		g.trial = trial
+		g.Unlock()
+
+		g.wait()
+		err := q.call()
+
+		g.Lock()
+		if trial {
+			g.trial = false
+		}
+		g.record(err)
+		dropped := false
+		switch {
+		case err == nil:
+			g.dequeue(q)
+		case g.failures > 0 && backendFailure(err):
+		default:
+			q.attempts++
+			if q.attempts >= maxQueuedAttempts {
+				g.dequeue(q)
+				dropped = true
+			}
+		}
+		if err != nil {
+			utils.G(g.ctx).WithField("service", q.id).WithField("operation", q.op).WithError(err).Error("queued operation failed")
+		}
+		metrics.QueuedOperations.WithLabelValues(g.scheme).Set(float64(len(g.queue)))
+		g.Unlock()
+
+		if dropped && g.dropped != nil {
+			g.dropped(q.op, q.id)
+		}
+	}
+}
+
+// enqueue must be called with the lock held.
+func (g *guard) enqueue(q *queuedOp) {
+	defer func() {
+		metrics.QueuedOperations.WithLabelValues(g.scheme).Set(float64(len(g.queue)))
+	}()
+
+	switch q.op {
+	case "deregister":
+		queue := g.queue[:0]
+		for _, queued := range g.queue {
+			if queued.id != q.id {
+				queue = append(queue, queued)
+			}
+		}
+		g.queue = append(queue, q)
+		return
+	case "refresh":
+		for _, queued := range g.queue {
+			if queued.id == q.id {
+				return
+			}
+		}
+	default:
+		for i, queued := range g.queue {
+			if queued.id == q.id && queued.op == q.op {
+				g.queue[i] = q
+				return
+			}
+		}
+	}
+	g.queue = append(g.queue, q)
+}
+
+// dequeue must be called with the lock held.
+func (g *guard) dequeue(q *queuedOp) {
+	for i, queued := range g.queue {
+		if queued == q {
+			g.queue = append(g.queue[:i], g.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// setState must be called with the lock held.
+func (g *guard) setState(state string) {
+	if g.state != "" {
+		log := utils.G(g.ctx).WithField("from", g.state).WithField("to", state).WithField("queued", len(g.queue))
+		if state == BreakerClosed {
+			log.Info("circuit breaker")
+		} else {
+			log.Warn("circuit breaker")
+		}
+	}
+	g.state = state
+	for _, s := range []string{BreakerClosed, BreakerOpen, BreakerHalfOpen} {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		metrics.BreakerState.WithLabelValues(g.scheme, s).Set(value)
+	}
+}
@@ -0,0 +1,204 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestGuard(config Config) *guard {
+	g := newGuard(context.Background(), "test", config)
+	g.cooldown = 10 * time.Millisecond
+	return g
+}
+
+func (g *guard) queued() int {
+	g.Lock()
+	defer g.Unlock()
+	return len(g.queue)
+}
+
+func (g *guard) breakerState() string {
+	g.Lock()
+	defer g.Unlock()
+	return g.state
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestGuardIgnoresErrorsOfAnAnsweringBackend(t *testing.T) {
+	g := newTestGuard(Config{BreakerFailures: 1})
+
+	for _, err := range []error{
+		context.Canceled,
+		ErrUnknownAgent,
+		fmt.Errorf("Register response status 400 Bad Request: %w", ErrRejected),
+	} {
+		err := err
+		if got := g.call(func() error { return err }); got != err {
+			t.Fatalf("err = %v, want %v", got, err)
+		}
+		if state := g.breakerState(); state != BreakerClosed {
+			t.Fatalf("breaker %s after %v", state, err)
+		}
+	}
+
+	g.call(func() error { return errors.New("connection refused") })
+	if state := g.breakerState(); state != BreakerOpen {
+		t.Fatalf("breaker %s after a transport error", state)
+	}
+}
+
+func TestGuardKeepsQueuedOperationsUntilTheBackendAnswers(t *testing.T) {
+	g := newTestGuard(Config{BreakerFailures: 1})
+	g.call(func() error { return errors.New("connection refused") })
+
+	var mu sync.Mutex
+	tries, done := 0, false
+	err := g.do("register", "web", func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		tries++
+		if tries <= 2*maxQueuedAttempts {
+			return errors.New("connection refused")
+		}
+		done = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the queued operation", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return done
+	})
+	waitFor(t, "the queue to drain", func() bool { return g.queued() == 0 })
+	if state := g.breakerState(); state != BreakerClosed {
+		t.Fatalf("breaker %s", state)
+	}
+}
+
+func TestGuardDropsQueuedOperationsTheBackendRefuses(t *testing.T) {
+	g := newTestGuard(Config{BreakerFailures: 1})
+	g.call(func() error { return errors.New("connection refused") })
+
+	var mu sync.Mutex
+	tries := 0
+	g.do("register", "web", func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		tries++
+		return ErrRejected
+	})
+	registered := make(chan struct{})
+	g.do("register", "db", func() error {
+		close(registered)
+		return nil
+	})
+
+	select {
+	case <-registered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the queue is blocked")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if tries != maxQueuedAttempts {
+		t.Fatalf("tries = %d, want %d", tries, maxQueuedAttempts)
+	}
+}
+
+func TestGuardQueuesOperationsWithoutToken(t *testing.T) {
+	g := newTestGuard(Config{RateLimit: 20, RateBurst: 1})
+	ran := make(chan string, 3)
+
+	start := time.Now()
+	for _, id := range []string{"a", "b", "c"} {
+		id := id
+		if err := g.do("register", id, func() error {
+			ran <- id
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Fatalf("do waited %s for tokens", elapsed)
+	}
+	if got := <-ran; got != "a" {
+		t.Fatalf("ran %s first", got)
+	}
+	if g.queued() == 0 {
+		t.Fatal("operations without token were not queued")
+	}
+
+	// replayed in order at the rate limit
+	for _, want := range []string{"b", "c"} {
+		select {
+		case got := <-ran:
+			if got != want {
+				t.Fatalf("ran %s, want %s", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s did not run", want)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Fatalf("rate limit not applied, took %s", elapsed)
+	}
+}
+
+func TestQueuedRegistrationIsNotChangedByTheBridge(t *testing.T) {
+	b, source, adapter := newTestBridge(t, Config{RateLimit: 20, RateBurst: 1})
+	id := putPod(t, source, "web", 80)
+
+	b.Add(id)
+	if b.guard.queued() == 0 {
+		t.Fatal("registration without token was not queued")
+	}
+	// let the drain wait for a token
+	time.Sleep(20 * time.Millisecond)
+	// the tracked service moves to the new agent while its registration
+	// waits in the queue
+	adapter.ForgetAgent()
+	if err := b.Heartbeat(); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the queue to drain", func() bool { return b.guard.queued() == 0 })
+	if service := adapter.Service(serviceId("web", 80)); service == nil || service.AgentId != "fake-agent-2" {
+		t.Fatalf("registered service = %+v", service)
+	}
+}
+
+func TestDroppedRegistrationIsRegisteredOnTheNextSync(t *testing.T) {
+	b, source, adapter := newTestBridge(t, Config{RateLimit: 100, RateBurst: 1})
+	id := putPod(t, source, "web", 80)
+	adapter.Err = fmt.Errorf("Register response status 400 Bad Request: %w", ErrRejected)
+
+	b.Add(id)
+	waitFor(t, "the registration to be dropped", func() bool { return len(b.Services()) == 0 })
+
+	adapter.Lock()
+	adapter.Err = nil
+	adapter.Unlock()
+	b.Sync(true)
+	waitFor(t, "the registration", func() bool { return adapter.Service(serviceId("web", 80)) != nil })
+	if len(b.Services()[id]) != 1 {
+		t.Fatalf("services = %v", b.Services())
+	}
+}
@@ -0,0 +1,85 @@
+package bridge
+
+import (
+	"fmt"
+	"net"
+)
+
+const (
+	// IPFamilyIPv4 registers the IPv4 address of a container, or its IPv6
+	// address when it has none.
+	IPFamilyIPv4 = "ipv4"
+	// IPFamilyIPv6 registers the IPv6 address of a container, or its IPv4
+	// address when it has none.
+	IPFamilyIPv6 = "ipv6"
+	// IPFamilyDual registers the first address the runtime reports and
+	// advertises one address of every family.
+	IPFamilyDual = "dual"
+)
+
+// ValidateIPFamily returns an error for an unknown -ip-family value.
+func ValidateIPFamily(family string) error {
+	switch family {
+	case IPFamilyIPv4, IPFamilyIPv6, IPFamilyDual:
+		return nil
+	}
+	return fmt.Errorf("unknown ip family %q, use %s, %s or %s", family, IPFamilyIPv4, IPFamilyIPv6, IPFamilyDual)
+}
+
+// podIPs returns the IPs of the pod of a container, or of the container when
+// it does not belong to a pod, in the order the runtime reports them.
+func podIPs(container *K8SScheduleContainer) []net.IP {
+	if container == nil || container.SandBoxMetadata == nil {
+		return nil
+	}
+	metadata := container.SandBoxMetadata.Metadata
+
+	var ips []net.IP
+	for _, address := range append([]string{metadata.IP}, metadata.AdditionalIPs...) {
+		if ip := net.ParseIP(address); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// addresses returns the addresses a service is registered with according
+// to the ip family, the primary address first. Single family settings return
+// at most one address.
+func (b *Bridge) addresses(ips []net.IP) []string {
+	var ipv4, ipv6 net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			if ipv4 == nil {
+				ipv4 = ip
+			}
+		} else if ipv6 == nil {
+			ipv6 = ip
+		}
+	}
+
+	var ordered []net.IP
+	switch b.config.IPFamily {
+	case IPFamilyIPv6:
+		ordered = []net.IP{ipv6, ipv4}
+	case IPFamilyDual:
+		if len(ips) > 0 && ips[0].To4() == nil {
+			ordered = []net.IP{ipv6, ipv4}
+		} else {
+			ordered = []net.IP{ipv4, ipv6}
+		}
+	default:
+		ordered = []net.IP{ipv4, ipv6}
+	}
+
+	var addresses []string
+	for _, ip := range ordered {
+		if ip != nil {
+			addresses = append(addresses, ip.String())
+		}
+	}
+	if b.config.IPFamily != IPFamilyDual && len(addresses) > 1 {
+		addresses = addresses[:1]
+	}
+	return addresses
+}
@@ -0,0 +1,61 @@
+package bridge
+
+import (
+	"reflect"
+	"registrator-containerd/pkg/ctrclient"
+	"testing"
+)
+
+func TestServicesAreRegisteredWithTheAddressesOfTheIPFamily(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		family string
+		ips    []string
+		want   []string
+	}{
+		{"ipv4 on an ipv6 only pod", IPFamilyIPv4, []string{"fd00::2"}, []string{"fd00::2"}},
+		{"dual on an ipv6 only pod", IPFamilyDual, []string{"fd00::2"}, []string{"fd00::2"}},
+		{"default", "", []string{"fd00::2", "10.0.0.2"}, []string{"10.0.0.2"}},
+		{"ipv4", IPFamilyIPv4, []string{"fd00::2", "10.0.0.2"}, []string{"10.0.0.2"}},
+		{"ipv6", IPFamilyIPv6, []string{"10.0.0.2", "fd00::2"}, []string{"fd00::2"}},
+		{"ipv6 without ipv6", IPFamilyIPv6, []string{"10.0.0.2"}, []string{"10.0.0.2"}},
+		{"dual", IPFamilyDual, []string{"10.0.0.2", "fd00::2", "10.0.0.3"}, []string{"10.0.0.2", "fd00::2"}},
+		{"dual ipv6 first", IPFamilyDual, []string{"fd00::2", "10.0.0.2"}, []string{"fd00::2", "10.0.0.2"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			b, source, _ := newTestBridge(t, Config{IPFamily: test.family})
+			container := NewFakeContainer(t, FakeContainer{
+				ID:        "k8s.io/web",
+				Name:      "web",
+				Namespace: ctrclient.K8sNamespace,
+				PodUID:    "uid-web",
+				IP:        test.ips[0],
+				Ports:     []ctrclient.PortMapping{{ContainerPort: 80, Protocol: "TCP"}},
+				Env:       map[string]string{"SERVICE_NAME": "web"},
+			})
+			container.SandBoxMetadata.Metadata.AdditionalIPs = test.ips[1:]
+			source.Put(container, StateRunning)
+
+			b.Add(container.ID)
+
+			services := b.Services()[container.ID]
+			if len(services) != 1 {
+				t.Fatalf("services = %v", b.Services())
+			}
+			if service := services[0]; service.IP != test.want[0] || !reflect.DeepEqual(service.IPs, test.want) {
+				t.Fatalf("ip = %q, ips = %q, want %q", service.IP, service.IPs, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateIPFamily(t *testing.T) {
+	for _, family := range []string{IPFamilyIPv4, IPFamilyIPv6, IPFamilyDual} {
+		if err := ValidateIPFamily(family); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ValidateIPFamily("ipv5"); err == nil {
+		t.Fatal("ipv5 is valid")
+	}
+}
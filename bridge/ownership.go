@@ -0,0 +1,83 @@
+package bridge
+
+import "registrator-containerd/pkg/ctrclient"
+
+// Every registration is stamped with these attrs, so that cleanup can tell
+// the services of this instance from the ones registered by others.
+const (
+	AttrInstance  = "registrator_instance"
+	AttrNode      = "registrator_node"
+	AttrContainer = "registrator_container"
+	AttrPodUid    = "registrator_pod_uid"
+)
+
+// instanceId returns the ID the services of this instance are stamped
+// with, the hostname unless configured.
+func (b *Bridge) instanceId() string {
+	if b.config.InstanceId != "" {
+		return b.config.InstanceId
+	}
+	return Hostname
+}
+
+// stampOwnership adds the ownership attrs to a new service, overriding any
+// SERVICE_ variables of the same name.
+func (b *Bridge) stampOwnership(service *Service) {
+	if service.Attrs == nil {
+		service.Attrs = make(map[string]string)
+	}
+	service.Attrs[AttrInstance] = b.instanceId()
+	service.Attrs[AttrNode] = Hostname
+	service.Attrs[AttrContainer] = service.Origin.ContainerID
+	if container := service.Origin.container; container.Kubernetes() {
+		service.Attrs[AttrPodUid] = container.Labels[ctrclient.PodUid]
+	}
+}
+
+// dangling reports whether a service of the backend was registered by this
+// instance for a container that no longer accounts for it. Services with
+// ownership attrs are matched by instance and ID, so that services with a
+// SERVICE_ID are found too. Older registrations without them are matched
+// by the hostname in their ID and by ID. It must be called with the lock
+// held.
+func (b *Bridge) dangling(extService *Service) bool {
+	if instance, ok := extService.Attrs[AttrInstance]; ok {
+		return instance == b.instanceId() && !b.tracked(extService.ID)
+	}
+
+	matches := serviceIDPattern.FindStringSubmatch(extService.ID)
+	if len(matches) != 4 {
+		// There's no way this was registered by us, so leave it
+		return false
+	}
+	serviceHostname := matches[1]
+
+	if serviceHostname != Hostname {
+		// ignore because registered on a different host
+		return false
+	}
+	// a container that sets SERVICE_ID is tracked under that ID, the
+	// registration under the generated ID is left over from an upgrade
+	return !b.tracked(extService.ID)
+}
+
+// tracked reports whether a service is registered for a running container
+// or kept for an exited one until its TTL expires. It must be called with
+// the lock held.
+func (b *Bridge) tracked(serviceId string) bool {
+	for _, services := range b.services {
+		for _, service := range services {
+			if service.ID == serviceId {
+				return true
+			}
+		}
+	}
+	for _, dead := range b.deadContainers {
+		for _, service := range dead.Services {
+			if service.ID == serviceId {
+				return true
+			}
+		}
+	}
+	return false
+}
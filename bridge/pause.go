@@ -0,0 +1,153 @@
+package bridge
+
+import (
+	"fmt"
+	"registrator-containerd/pkg/metrics"
+	"time"
+)
+
+const (
+	// PauseMaintenance keeps the services of a paused container registered
+	// in maintenance.
+	PauseMaintenance = "maintenance"
+	// PauseDeregister deregisters the services of a paused container until
+	// it is resumed.
+	PauseDeregister = "deregister"
+)
+
+// ValidatePausePolicy returns an error for an unknown -pause-policy value.
+func ValidatePausePolicy(policy string) error {
+	switch policy {
+	case PauseMaintenance, PauseDeregister:
+		return nil
+	}
+	return fmt.Errorf("unknown pause policy %q, use %s or %s", policy, PauseMaintenance, PauseDeregister)
+}
+
+// Pause takes the services of a paused container out of service according
+// to the pause policy. Maintenance falls back to deregistering when the
+// adapter does not support it.
+func (b *Bridge) Pause(containerId string) {
+	b.Lock()
+	defer b.Unlock()
+	defer b.updateGauges()
+
+	if b.paused[containerId] {
+		return
+	}
+	b.paused[containerId] = true
+	b.stopWarmup(containerId)
+
+	services := b.services[containerId]
+	if len(services) == 0 {
+		return
+	}
+	b.containerLog(containerId).Info("paused")
+
+	if b.caps.Maintenance && b.config.PausePolicy != PauseDeregister {
+		for _, service := range services {
+			b.setMaintenance(service, true, "container is paused")
+		}
+		return
+	}
+	for _, service := range services {
+		err := b.deregister(service)
+		if err != nil {
+			b.serviceLog(service).WithError(err).Error("deregister failed")
+			continue
+		}
+		b.serviceLog(service).Info("removed")
+	}
+	delete(b.services, containerId)
+}
+
+// Resume restores the services of a container that was paused.
+func (b *Bridge) Resume(containerId string) {
+	b.Lock()
+	defer b.Unlock()
+	defer b.updateGauges()
+
+	if !b.paused[containerId] {
+		return
+	}
+	delete(b.paused, containerId)
+	b.containerLog(containerId).Info("resumed")
+
+	services := b.services[containerId]
+	if services == nil {
+		b.add(containerId, false)
+		return
+	}
+	if _, unready := b.unready[containerId]; unready && b.readinessPolicy == ReadinessCritical {
+		// stays in maintenance until the pod is ready
+		return
+	}
+	for _, service := range services {
+		b.setMaintenance(service, false, "")
+	}
+}
+
+// OOM reports that a process of a container was killed for running out of
+// memory. Adapters that support it get a warning status with a note, which
+// is cleared after the configured period.
+func (b *Bridge) OOM(containerId string) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.containerLog(containerId).Warn("out of memory")
+
+	services := b.services[containerId]
+	adapter := b.statusAdapter()
+	if adapter == nil || len(services) == 0 {
+		return
+	}
+
+	note := "OOM killed at " + time.Now().Format(time.RFC3339)
+	for _, service := range services {
+		b.setStatus(adapter, service, HealthWarning, note)
+	}
+
+	b.stopOOMWarning(containerId)
+	if b.config.OOMWarning <= 0 {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Duration(b.config.OOMWarning)*time.Second, func() {
+		b.Lock()
+		defer b.Unlock()
+		if b.oomWarnings[containerId] != timer {
+			return
+		}
+		delete(b.oomWarnings, containerId)
+		for _, service := range b.services[containerId] {
+			b.setStatus(adapter, service, HealthPassing, "")
+		}
+	})
+	b.oomWarnings[containerId] = timer
+}
+
+// stopOOMWarning must be called with the lock held.
+func (b *Bridge) stopOOMWarning(containerId string) {
+	if timer := b.oomWarnings[containerId]; timer != nil {
+		timer.Stop()
+		delete(b.oomWarnings, containerId)
+	}
+}
+
+func (b *Bridge) setStatus(adapter StatusAdapter, service *Service, status string, note string) {
+	service = queued(service)
+	timeout := b.config.AdapterTimeout
+	err := b.guard.do("status", service.ID, func() error {
+		ctx, cancel := b.opContext(timeout)
+		defer cancel()
+		start := time.Now()
+		err := adapter.SetStatus(ctx, service, status, note)
+		metrics.ObserveRegistry(b.scheme, "status", start, err)
+		return err
+	})
+	if err != nil {
+		b.serviceLog(service).WithError(err).Error("set status failed")
+		return
+	}
+	b.serviceLog(service).WithField("status", status).Info("status")
+}
@@ -0,0 +1,90 @@
+package bridge
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPausePolicies(t *testing.T) {
+	web := serviceId("web", 80)
+	for _, test := range []struct {
+		name        string
+		policy      string
+		maintenance bool
+		pause       []string
+		resume      []string
+	}{
+		{"maintenance", PauseMaintenance, true, []string{"maintenance:" + web}, []string{"ready:" + web}},
+		{"deregister", PauseDeregister, true, []string{"deregister:" + web}, []string{"register:" + web}},
+		{"maintenance unsupported", PauseMaintenance, false, []string{"deregister:" + web}, []string{"register:" + web}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			b, source, adapter := newTestBridge(t, Config{PausePolicy: test.policy})
+			b.Lock()
+			b.caps.Maintenance = test.maintenance
+			b.Unlock()
+			id := putPod(t, source, "web", 80)
+			b.Add(id)
+			adapter.Calls()
+
+			source.SetState(id, StatePaused)
+			b.Pause(id)
+			b.Pause(id)
+			assertCalls(t, adapter, test.pause...)
+			// a sync does not add the deregistered services again
+			b.Sync(false)
+			adapter.Calls()
+			if deregistered := strings.HasPrefix(test.pause[0], "deregister:"); deregistered != (len(b.Services()[id]) == 0) {
+				t.Fatalf("services = %v while paused", b.Services())
+			}
+
+			source.SetState(id, StateRunning)
+			b.Resume(id)
+			assertCalls(t, adapter, test.resume...)
+			if len(b.Services()[id]) != 1 {
+				t.Fatalf("services = %v", b.Services())
+			}
+		})
+	}
+}
+
+func TestOOMSetsAWarningUntilTheConfiguredPeriodEnds(t *testing.T) {
+	b, source, adapter := newTestBridge(t, Config{OOMWarning: 1})
+	id := putPod(t, source, "web", 80)
+	b.Add(id)
+	adapter.Calls()
+
+	b.OOM(id)
+	assertCalls(t, adapter, "warning:"+serviceId("web", 80))
+
+	var calls []string
+	waitFor(t, "the warning to be cleared", func() bool {
+		calls = append(calls, adapter.Calls()...)
+		return len(calls) > 0
+	})
+	if want := []string{"passing:" + serviceId("web", 80)}; !reflect.DeepEqual(calls, want) {
+		t.Fatalf("calls = %q, want %q", calls, want)
+	}
+
+	// a container without services has no status to set
+	b.OOM("k8s.io/unknown")
+	assertCalls(t, adapter)
+}
+
+func TestOOMWarningIsKeptWithoutAPeriod(t *testing.T) {
+	b, source, adapter := newTestBridge(t, Config{})
+	id := putPod(t, source, "web", 80)
+	b.Add(id)
+	adapter.Calls()
+
+	b.OOM(id)
+	b.Lock()
+	timers := len(b.oomWarnings)
+	b.Unlock()
+
+	assertCalls(t, adapter, "warning:"+serviceId("web", 80))
+	if timers != 0 {
+		t.Fatalf("oom warnings = %d, want none to clear", timers)
+	}
+}
@@ -0,0 +1,146 @@
+package bridge
+
+import (
+	"fmt"
+	"registrator-containerd/pkg/ctrclient"
+	"registrator-containerd/pkg/metrics"
+	"registrator-containerd/utils"
+	"time"
+)
+
+const (
+	// ReadinessDeregister keeps the services of unready pods out of the
+	// registry.
+	ReadinessDeregister = "deregister"
+	// ReadinessCritical registers the services of unready pods in
+	// maintenance, so that they are reported as critical.
+	ReadinessCritical = "critical"
+)
+
+// ReadinessGate reports whether a pod is ready to receive traffic.
+type ReadinessGate interface {
+	PodReady(podUid string) bool
+}
+
+// SetReadinessGate holds back the services of Kubernetes containers until
+// their pod is ready. The policy decides what happens to the services of a
+// pod that is not ready. ReadinessCritical falls back to ReadinessDeregister
+// when the adapter does not support maintenance. Call ReadinessChanged
+// whenever the readiness of pods changes.
+func (b *Bridge) SetReadinessGate(gate ReadinessGate, policy string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	switch policy {
+	case ReadinessDeregister:
+	case ReadinessCritical:
+		if !b.caps.Maintenance {
+			utils.G(b.ctx).WithField("policy", policy).Warn("adapter does not support maintenance, deregistering services of unready pods instead")
+			policy = ReadinessDeregister
+		}
+	default:
+		return fmt.Errorf("unknown readiness policy %q, use %s or %s", policy, ReadinessDeregister, ReadinessCritical)
+	}
+
+	b.readiness = gate
+	b.readinessPolicy = policy
+	return nil
+}
+
+// ReadinessChanged applies the readiness of the pods to the services of the
+// tracked containers: services of pods that became ready are registered or
+// leave maintenance, the ones of pods that are no longer ready are
+// deregistered or put into maintenance.
+func (b *Bridge) ReadinessChanged() {
+	b.Lock()
+	defer b.Unlock()
+	defer b.updateGauges()
+
+	if b.readiness == nil {
+		return
+	}
+
+	for containerId, services := range b.services {
+		if _, held := b.unready[containerId]; held {
+			continue
+		}
+		podUid, ready := b.podReady(services)
+		if ready {
+			continue
+		}
+		b.unready[containerId] = podUid
+		b.containerLog(containerId).Info("pod is no longer ready")
+		if b.readinessPolicy == ReadinessCritical {
+			for _, service := range services {
+				b.setMaintenance(service, true, "pod is not ready")
+			}
+			continue
+		}
+		for _, service := range services {
+			err := b.deregister(service)
+			if err != nil {
+				b.serviceLog(service).WithError(err).Error("deregister failed")
+				continue
+			}
+			b.serviceLog(service).Info("removed")
+		}
+		delete(b.services, containerId)
+	}
+
+	for containerId, podUid := range b.unready {
+		if !b.readiness.PodReady(podUid) {
+			continue
+		}
+		b.containerLog(containerId).Info("pod is ready")
+		services := b.services[containerId]
+		if services == nil {
+			b.add(containerId, false)
+			continue
+		}
+		delete(b.unready, containerId)
+		if b.paused[containerId] {
+			// stays in maintenance until resumed
+			continue
+		}
+		for _, service := range services {
+			b.setMaintenance(service, false, "")
+		}
+	}
+}
+
+// podReady returns the pod of the services and whether the readiness gate
+// lets them be registered. Services of non-Kubernetes containers are always
+// ready.
+func (b *Bridge) podReady(services []*Service) (string, bool) {
+	if b.readiness == nil || len(services) == 0 {
+		return "", true
+	}
+	container := services[0].Origin.container
+	if !container.Kubernetes() {
+		return "", true
+	}
+	podUid := container.Labels[ctrclient.PodUid]
+	return podUid, b.readiness.PodReady(podUid)
+}
+
+func (b *Bridge) setMaintenance(service *Service, enable bool, reason string) {
+	adapter := b.maintenanceAdapter()
+	if adapter == nil {
+		return
+	}
+	service = queued(service)
+	timeout := b.config.AdapterTimeout
+	err := b.guard.do("maintenance", service.ID, func() error {
+		ctx, cancel := b.opContext(timeout)
+		defer cancel()
+		start := time.Now()
+		err := adapter.Maintenance(ctx, service, enable, reason)
+		metrics.ObserveRegistry(b.scheme, "maintenance", start, err)
+		return err
+	})
+	if err != nil {
+		b.serviceLog(service).WithError(err).Error("maintenance failed")
+		return
+	}
+	b.serviceLog(service).WithField("enable", enable).Info("maintenance")
+}
@@ -0,0 +1,105 @@
+package bridge
+
+import (
+	"sync"
+	"testing"
+)
+
+// fakeGate is a ReadinessGate over a set of ready pods.
+type fakeGate struct {
+	sync.Mutex
+	ready map[string]bool
+}
+
+func (g *fakeGate) PodReady(podUid string) bool {
+	g.Lock()
+	defer g.Unlock()
+	return g.ready[podUid]
+}
+
+func (g *fakeGate) set(podUid string, ready bool) {
+	g.Lock()
+	defer g.Unlock()
+	g.ready[podUid] = ready
+}
+
+func newGatedBridge(t *testing.T, policy string, maintenance bool) (*Bridge, *FakeSource, *FakeAdapter, *fakeGate) {
+	t.Helper()
+	b, source, adapter := newTestBridge(t, Config{})
+	b.Lock()
+	b.caps.Maintenance = maintenance
+	b.Unlock()
+	gate := &fakeGate{ready: make(map[string]bool)}
+	if err := b.SetReadinessGate(gate, policy); err != nil {
+		t.Fatal(err)
+	}
+	return b, source, adapter, gate
+}
+
+func TestReadinessGateWithholdsUnreadyPods(t *testing.T) {
+	web := serviceId("web", 80)
+	for _, test := range []struct {
+		name        string
+		policy      string
+		maintenance bool
+	}{
+		{"deregister", ReadinessDeregister, true},
+		{"critical unsupported", ReadinessCritical, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			b, source, adapter, gate := newGatedBridge(t, test.policy, test.maintenance)
+			id := putPod(t, source, "web", 80)
+
+			b.Add(id)
+			assertCalls(t, adapter)
+			if services := b.Services(); len(services) != 0 {
+				t.Fatalf("services = %v", services)
+			}
+
+			gate.set("uid-web", true)
+			b.ReadinessChanged()
+			assertCalls(t, adapter, "register:"+web)
+			b.ReadinessChanged()
+			assertCalls(t, adapter)
+
+			gate.set("uid-web", false)
+			b.ReadinessChanged()
+			assertCalls(t, adapter, "deregister:"+web)
+			if services := b.Services(); len(services) != 0 {
+				t.Fatalf("services = %v", services)
+			}
+
+			gate.set("uid-web", true)
+			b.ReadinessChanged()
+			assertCalls(t, adapter, "register:"+web)
+		})
+	}
+}
+
+func TestReadinessGateMarksUnreadyPodsCritical(t *testing.T) {
+	web := serviceId("web", 80)
+	b, source, adapter, gate := newGatedBridge(t, ReadinessCritical, true)
+	id := putPod(t, source, "web", 80)
+
+	b.Add(id)
+	assertCalls(t, adapter, "register:"+web, "maintenance:"+web)
+
+	gate.set("uid-web", true)
+	b.ReadinessChanged()
+	assertCalls(t, adapter, "ready:"+web)
+
+	gate.set("uid-web", false)
+	b.ReadinessChanged()
+	b.ReadinessChanged()
+	assertCalls(t, adapter, "maintenance:"+web)
+	if len(b.Services()[id]) != 1 {
+		t.Fatalf("services = %v", b.Services())
+	}
+}
+
+func TestReadinessGateRejectsUnknownPolicies(t *testing.T) {
+	b, _, _ := newTestBridge(t, Config{})
+	if err := b.SetReadinessGate(&fakeGate{}, "ignore"); err == nil {
+		t.Fatal("unknown policy accepted")
+	}
+}
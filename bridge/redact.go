@@ -0,0 +1,159 @@
+package bridge
+
+import (
+	"encoding/json"
+	"regexp"
+	"sync"
+)
+
+const (
+	// DefaultRedactKeys matches attribute names whose values are never logged.
+	DefaultRedactKeys = `(?i)(token|secret|passw(or)?d|api_?key|access_?key|auth|credential)`
+	// DefaultRedactValues matches secrets embedded in values such as check
+	// URLs: credentials in query strings and the password part of userinfo.
+	DefaultRedactValues = `(?i)(?:token|secret|passw(?:or)?d|api_?key|access_?key|auth|signature)=([^&\s]+)|://[^:/@\s]+:([^@/\s]+)@`
+
+	redactedValue = "***"
+)
+
+// Redactor masks secrets in services before they are logged or returned by
+// the admin API. The services sent to the backend are never modified.
+type Redactor struct {
+	keys   *regexp.Regexp
+	values *regexp.Regexp
+}
+
+var redaction = struct {
+	sync.RWMutex
+	redactor *Redactor
+}{
+	redactor: MustRedactor(DefaultRedactKeys, DefaultRedactValues),
+}
+
+// NewRedactor compiles the key and value patterns, either may be empty.
+// Attributes whose name matches keys are masked entirely. For values the
+// text captured by the groups of the pattern is masked, or the whole match
+// when the pattern has no groups.
+func NewRedactor(keys string, values string) (*Redactor, error) {
+	r := new(Redactor)
+	var err error
+	if keys != "" {
+		if r.keys, err = regexp.Compile(keys); err != nil {
+			return nil, err
+		}
+	}
+	if values != "" {
+		if r.values, err = regexp.Compile(values); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func MustRedactor(keys string, values string) *Redactor {
+	r, err := NewRedactor(keys, values)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// SetRedactor replaces the redactor used by Service.Redacted.
+func SetRedactor(r *Redactor) {
+	redaction.Lock()
+	defer redaction.Unlock()
+	redaction.redactor = r
+}
+
+func currentRedactor() *Redactor {
+	redaction.RLock()
+	defer redaction.RUnlock()
+	return redaction.redactor
+}
+
+// Redacted returns a copy of the service that is safe to log: sensitive
+// attributes and attributes matching the key pattern are masked, and
+// secrets matching the value pattern are masked in attributes and tags.
+func (s *Service) Redacted() *Service {
+	if s == nil {
+		return nil
+	}
+	r := currentRedactor()
+	out := *s
+	out.Tags = make([]string, len(s.Tags))
+	for i, tag := range s.Tags {
+		out.Tags[i] = r.value(tag)
+	}
+	if s.Attrs != nil {
+		sensitive := make(map[string]bool, len(s.Sensitive))
+		for _, key := range s.Sensitive {
+			sensitive[key] = true
+		}
+		out.Attrs = make(map[string]string, len(s.Attrs))
+		for key, value := range s.Attrs {
+			if sensitive[key] || (r.keys != nil && r.keys.MatchString(key)) {
+				out.Attrs[key] = redactedValue
+				continue
+			}
+			out.Attrs[key] = r.value(value)
+		}
+	}
+	return &out
+}
+
+// RedactedJSON serialises the redacted copy of the service for logging.
+func (s *Service) RedactedJSON() string {
+	data, err := json.Marshal(s.Redacted())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// RedactServices returns redacted copies of services.
+func RedactServices(services []*Service) []*Service {
+	out := make([]*Service, len(services))
+	for i, service := range services {
+		out[i] = service.Redacted()
+	}
+	return out
+}
+
+// Redact masks the secrets matching the value pattern in a text, e.g. an
+// error message of the backend.
+func Redact(text string) string {
+	return currentRedactor().value(text)
+}
+
+func (r *Redactor) value(value string) string {
+	if r.values == nil || value == "" {
+		return value
+	}
+	matches := r.values.FindAllStringSubmatchIndex(value, -1)
+	if matches == nil {
+		return value
+	}
+	out := make([]byte, 0, len(value))
+	last := 0
+	for _, m := range matches {
+		spans := [][2]int{}
+		for g := 2; g < len(m); g += 2 {
+			if m[g] >= 0 {
+				spans = append(spans, [2]int{m[g], m[g+1]})
+			}
+		}
+		if len(spans) == 0 && r.values.NumSubexp() == 0 {
+			spans = append(spans, [2]int{m[0], m[1]})
+		}
+		for _, span := range spans {
+			if span[0] < last {
+				continue
+			}
+			out = append(out, value[last:span[0]]...)
+			out = append(out, redactedValue...)
+			last = span[1]
+		}
+	}
+	out = append(out, value[last:]...)
+	return string(out)
+}
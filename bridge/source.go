@@ -0,0 +1,69 @@
+package bridge
+
+import (
+	"context"
+	"time"
+)
+
+// ContainerState is the state of the task of a container.
+type ContainerState string
+
+const (
+	StateUnknown ContainerState = "unknown"
+	StateCreated ContainerState = "created"
+	StateRunning ContainerState = "running"
+	StatePaused  ContainerState = "paused"
+	StateStopped ContainerState = "stopped"
+)
+
+// ContainerSource is the container runtime the bridge reads containers from.
+type ContainerSource interface {
+	EventSource
+
+	// Ping reports whether the runtime is reachable.
+	Ping(ctx context.Context) error
+	// Version returns the name and version of the runtime, e.g.
+	// "containerd v1.7.20".
+	Version(ctx context.Context) (string, error)
+	// List returns the IDs of all containers.
+	List(ctx context.Context) ([]string, error)
+	// Inspect returns the container, or nil when the container is not a
+	// workload that can be registered, e.g. a pod sandbox.
+	Inspect(ctx context.Context, containerId string) (*K8SScheduleContainer, error)
+	// Status returns the state of the task of the container.
+	Status(ctx context.Context, containerId string) (ContainerState, error)
+}
+
+// EventType is the kind of a container event the bridge reacts to.
+type EventType string
+
+const (
+	EventStart  EventType = "start"
+	EventDelete EventType = "delete"
+	// EventUpdate is sent when the labels or the spec of a container change.
+	EventUpdate EventType = "update"
+	EventPause  EventType = "pause"
+	EventResume EventType = "resume"
+	// EventOOM is sent when a process of a container was killed for
+	// running out of memory, the container may keep running.
+	EventOOM   EventType = "oom"
+	EventOther EventType = "other"
+)
+
+// ContainerEvent is a container lifecycle event reported by a runtime.
+type ContainerEvent struct {
+	Type EventType
+	// Topic is the runtime specific name of the event, e.g. /tasks/start.
+	Topic       string
+	Namespace   string
+	ContainerID string
+	Timestamp   time.Time
+	// Payload is the decoded runtime event, it is only used for logging.
+	Payload any
+}
+
+// EventSource streams the container events of a runtime. The error channel
+// receives at most one error, after which both channels are done.
+type EventSource interface {
+	Events(ctx context.Context) (<-chan *ContainerEvent, <-chan error)
+}
@@ -1,8 +1,12 @@
 package bridge
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/containerd/containerd/containers"
 	"net/url"
+	"reflect"
 	"registrator-containerd/pkg/ctrclient"
 )
 
@@ -10,6 +14,9 @@ type AdapterFactory interface {
 	New(uri *url.URL) RegistryAdapter
 }
 
+// RegistryAdapter is the original adapter interface, without a context. The
+// bridge runs it through NewLegacyAdapter, new adapters implement
+// RegistryAdapterV2.
 type RegistryAdapter interface {
 	RegisterAgentNode(dataCenterId string, hostIp string) (string, error)
 	Ping(agentId string) error
@@ -19,6 +26,85 @@ type RegistryAdapter interface {
 	Services(agentId string) ([]*Service, error)
 }
 
+// AdapterFactoryV2 is implemented by the factories of context-aware
+// adapters. They implement AdapterFactory as well, so that they are
+// registered the same way; the bridge prefers NewV2.
+type AdapterFactoryV2 interface {
+	NewV2(uri *url.URL) RegistryAdapterV2
+}
+
+// RegistryAdapterV2 is the context-aware registry adapter interface. The
+// context of every call carries the timeout of the operation and is
+// cancelled on shutdown. Register is called for new services, Update for
+// registered services whose definition changed.
+type RegistryAdapterV2 interface {
+	RegisterAgentNode(ctx context.Context, agent Agent) (string, error)
+	Ping(ctx context.Context, agentId string) error
+	Register(ctx context.Context, service *Service) error
+	Update(ctx context.Context, service *Service) error
+	Deregister(ctx context.Context, service *Service) error
+	Refresh(ctx context.Context, service *Service) error
+	Services(ctx context.Context, agentId string) ([]*Service, error)
+}
+
+// Agent describes the node registrator runs on to the backend.
+type Agent struct {
+	DataCenterId string
+	HostIp       string
+	Hostname     string
+	// Version is the version of registrator
+	Version string
+	// Runtime is the name and version of the container runtime
+	Runtime    string
+	Containers int
+}
+
+// ErrUnknownAgent is returned by Ping when the backend has no record of the
+// agent, the bridge registers the agent and its services again.
+var ErrUnknownAgent = errors.New("agent is unknown to the backend")
+
+// ErrRejected is wrapped by adapters in the errors of operations that were
+// refused rather than lost, e.g. a request the backend answered with a
+// client error. The circuit breaker does not count them as failures.
+var ErrRejected = errors.New("operation rejected")
+
+// BatchAdapter is implemented by adapters that register or deregister
+// several services in one call. RegisterBatch registers new services and
+// updates changed ones. A *BatchError reports the services that failed, any
+// other error applies to all of them.
+type BatchAdapter interface {
+	RegisterBatch(ctx context.Context, services []*Service) error
+	DeregisterBatch(ctx context.Context, services []*Service) error
+}
+
+// BatchError maps the IDs of the services a batch call failed for to their
+// error.
+type BatchError struct {
+	Errors map[string]error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d services failed", len(e.Errors))
+}
+
+// MaintenanceAdapter is implemented by adapters that can keep a service
+// registered while reporting it as unhealthy.
+type MaintenanceAdapter interface {
+	Maintenance(ctx context.Context, service *Service, enable bool, reason string) error
+}
+
+// StatusAdapter is implemented by adapters that can report a health status
+// with a note for a registered service.
+type StatusAdapter interface {
+	SetStatus(ctx context.Context, service *Service, status string, note string) error
+}
+
+const (
+	HealthPassing  = "passing"
+	HealthWarning  = "warning"
+	HealthCritical = "critical"
+)
+
 type Config struct {
 	HostIp          string
 	Internal        bool
@@ -30,18 +116,84 @@ type Config struct {
 	DeregisterCheck string
 	Cleanup         bool
 	DataCenterId    string
+	IPFamily        string
+	// CleanupDryRun only logs the dangling services. CleanupMax limits the
+	// services removed per pass, CleanupAbort is the percentage of the
+	// listed services above which a pass is aborted, 0 disables either.
+	// Services whose name or ID match the CleanupProtect regexp are never
+	// removed, others only after being dangling for CleanupGrace seconds.
+	CleanupDryRun  bool
+	CleanupMax     int
+	CleanupAbort   int
+	CleanupProtect string
+	CleanupGrace   int
+	// Warmup probes services before they are registered, WarmupTimeout and
+	// WarmupInterval are in milliseconds.
+	Warmup         bool
+	WarmupTimeout  int
+	WarmupInterval int
+	WarmupAttempts int
+	// PausePolicy is PauseMaintenance or PauseDeregister
+	PausePolicy string
+	// OOMWarning is how long, in seconds, services report a warning after
+	// an OOM kill
+	OOMWarning int
+	// FlapThreshold is the number of starts within FlapWindow seconds after
+	// which a container is flapping, 0 disables flap damping. A flapping
+	// container is restored after it stays up for FlapStable seconds.
+	FlapThreshold int
+	FlapWindow    int
+	FlapStable    int
+	// FlapPolicy is FlapSuppress or FlapCritical
+	FlapPolicy string
+	// RateLimit is the number of backend operations per second, 0 is
+	// unlimited. BreakerFailures consecutive failures open the circuit for
+	// BreakerCooldown seconds, 0 disables the breaker.
+	RateLimit       float64
+	RateBurst       int
+	BreakerFailures int
+	BreakerCooldown int
+	// AdapterTimeout is the timeout of every backend operation in seconds,
+	// 0 leaves it to the adapter.
+	AdapterTimeout int
+	// BatchSize is the maximum number of services of a batch call, a batch
+	// is also sent when it is older than BatchInterval milliseconds.
+	BatchSize     int
+	BatchInterval int
+	// Version is the version of registrator reported to the backend
+	Version string
+	// InstanceId identifies this instance in the ownership attrs of its
+	// services, the hostname when empty
+	InstanceId string
 }
 
 type Service struct {
-	ID      string
-	Name    string
-	Port    int
-	IP      string
+	ID   string
+	Name string
+	Port int
+	IP   string
+	// IPs are the addresses of the service by ip family, IP first
+	IPs     []string
 	Tags    []string
 	Attrs   map[string]string
 	TTL     int
 	AgentId string
 	Origin  ServicePort
+	// Sensitive lists attrs that are sent to the backend but never logged
+	Sensitive []string `json:"-"`
+}
+
+// Equal reports whether both services would be registered identically.
+func (s *Service) Equal(o *Service) bool {
+	return s.ID == o.ID &&
+		s.Name == o.Name &&
+		s.Port == o.Port &&
+		s.IP == o.IP &&
+		reflect.DeepEqual(s.IPs, o.IPs) &&
+		s.TTL == o.TTL &&
+		reflect.DeepEqual(s.Tags, o.Tags) &&
+		reflect.DeepEqual(s.Attrs, o.Attrs) &&
+		reflect.DeepEqual(s.Sensitive, o.Sensitive)
 }
 
 type ServicePort struct {
@@ -53,7 +205,10 @@ type ServicePort struct {
 	ContainerHostname string
 	ContainerID       string
 	ContainerName     string
-	container         *K8SScheduleContainer
+	// Network is the CNI network ExposedIP belongs to when the service was
+	// placed on a network with SERVICE_NETWORK
+	Network   string
+	container *K8SScheduleContainer
 }
 
 type DeadContainer struct {
@@ -64,9 +219,31 @@ type DeadContainer struct {
 type K8SScheduleContainer struct {
 	ID                string
 	Name              string
+	Namespace         string
+	Labels            map[string]string
 	Container         *containers.Container
 	ContainerMetadata *ctrclient.ContainerMetadata
 	ContainerSpec     *ctrclient.ContainerSpec
 	SandBoxContainer  *containers.Container
 	SandBoxMetadata   *ctrclient.ContainerMetadata
+	// Networks are the CNI attachments of the pod, or of the container when
+	// it does not belong to a pod.
+	Networks []ctrclient.CNIResult
+}
+
+// Kubernetes reports whether the container belongs to a pod.
+func (c *K8SScheduleContainer) Kubernetes() bool {
+	return c != nil && c.Labels[ctrclient.PodUid] != ""
+}
+
+// PodName returns "namespace/name" of the pod the container belongs to.
+func (c *K8SScheduleContainer) PodName() string {
+	if c == nil {
+		return ""
+	}
+	name := c.Labels[ctrclient.PodName]
+	if name == "" {
+		return ""
+	}
+	return c.Labels[ctrclient.PodNamespace] + "/" + name
 }
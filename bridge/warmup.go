@@ -0,0 +1,144 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var probeClient = &http.Client{
+	Transport: &http.Transport{DisableKeepAlives: true},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// warmup tracks the services of a container that are probed before they
+// are registered.
+type warmup struct {
+	cancel  context.CancelFunc
+	pending int
+}
+
+// startWarmup probes every service in the background and registers it once
+// the probe succeeds. The lock is not held while probing. It must be called
+// with the lock held.
+func (b *Bridge) startWarmup(containerId string, services []*Service) {
+	if len(services) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(b.ctx)
+	w := &warmup{cancel: cancel, pending: len(services)}
+	b.warmups[containerId] = w
+
+	config := b.config
+	for _, service := range services {
+		b.serviceLog(service).Debug("warming up")
+		go func(service *Service) {
+			err := warmupProbe(ctx, service, config)
+			b.finishWarmup(containerId, w, service, err)
+		}(service)
+	}
+}
+
+// stopWarmup cancels the probes of a container. It must be called with the
+// lock held.
+func (b *Bridge) stopWarmup(containerId string) {
+	if w := b.warmups[containerId]; w != nil {
+		w.cancel()
+		delete(b.warmups, containerId)
+	}
+}
+
+func (b *Bridge) finishWarmup(containerId string, w *warmup, service *Service, err error) {
+	b.Lock()
+	defer b.Unlock()
+	defer b.updateGauges()
+
+	if b.warmups[containerId] != w {
+		// the container was removed or re-registered meanwhile
+		return
+	}
+	w.pending--
+	if w.pending == 0 {
+		w.cancel()
+		delete(b.warmups, containerId)
+	}
+
+	if err != nil {
+		b.serviceLog(service).WithError(err).Warn("ignored: warm-up probe failed")
+		return
+	}
+
+	// readiness may have changed while probing
+	podUid, ready := b.podReady([]*Service{service})
+	if !ready {
+		b.unready[containerId] = podUid
+		if b.readinessPolicy != ReadinessCritical {
+			b.serviceLog(service).Info("pending: pod is not ready")
+			return
+		}
+	}
+	b.addService(containerId, service, ready)
+}
+
+// warmupProbe probes a service until it succeeds, the attempts are used up
+// or ctx is done.
+func warmupProbe(ctx context.Context, service *Service, config Config) error {
+	timeout := time.Duration(config.WarmupTimeout) * time.Millisecond
+	interval := time.Duration(config.WarmupInterval) * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := probe(ctx, service, timeout)
+		if err == nil {
+			return nil
+		}
+		if attempt >= config.WarmupAttempts {
+			return fmt.Errorf("%d attempts: %w", attempt, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// probe sends a GET to the check_http path of the service if it has one,
+// otherwise it connects to the port. UDP services are not probed.
+func probe(ctx context.Context, service *Service, timeout time.Duration) error {
+	if service.Origin.PortType == "udp" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	address := net.JoinHostPort(service.IP, strconv.Itoa(service.Port))
+	if path := service.Attrs["check_http"]; path != "" {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+address+path, nil)
+		if err != nil {
+			return err
+		}
+		response, err := probeClient.Do(request)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		if response.StatusCode >= http.StatusBadRequest {
+			return fmt.Errorf("GET %s: %s", path, response.Status)
+		}
+		return nil
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,120 @@
+package bridge
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"registrator-containerd/pkg/ctrclient"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// putProbed adds a pod whose service is the test server, checked at
+// /health.
+func putProbed(t *testing.T, source *FakeSource, server *httptest.Server) (string, string) {
+	t.Helper()
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	containerPort, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	container := NewFakeContainer(t, FakeContainer{
+		ID:        "k8s.io/web",
+		Name:      "web",
+		Namespace: ctrclient.K8sNamespace,
+		PodUID:    "uid-web",
+		IP:        host,
+		Ports:     []ctrclient.PortMapping{{ContainerPort: containerPort, Protocol: "TCP"}},
+		Env:       map[string]string{"SERVICE_NAME": "web", "SERVICE_CHECK_HTTP": "/health"},
+	})
+	source.Put(container, StateRunning)
+	return container.ID, serviceId("web", containerPort)
+}
+
+func warmingUp(b *Bridge) int {
+	b.Lock()
+	defer b.Unlock()
+	return len(b.warmups)
+}
+
+func TestWarmupRegistersOnceTheProbeSucceeds(t *testing.T) {
+	var probes atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" || probes.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(server.Close)
+	b, source, adapter := newTestBridge(t, Config{Warmup: true, WarmupTimeout: 1000, WarmupInterval: 10, WarmupAttempts: 5})
+	id, serviceId := putProbed(t, source, server)
+
+	b.Add(id)
+	if services := b.Services(); len(services) != 0 {
+		t.Fatalf("registered before the probe succeeded: %v", services)
+	}
+	waitFor(t, "the registration", func() bool { return adapter.Service(serviceId) != nil })
+
+	if got := probes.Load(); got != 3 {
+		t.Fatalf("probes = %d, want 3", got)
+	}
+	if len(b.Services()[id]) != 1 || warmingUp(b) != 0 {
+		t.Fatalf("services = %v, warming up = %d", b.Services(), warmingUp(b))
+	}
+}
+
+func TestWarmupGivesUpAfterTimedOutProbes(t *testing.T) {
+	release := make(chan struct{})
+	var probes atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+		<-release
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+	b, source, adapter := newTestBridge(t, Config{Warmup: true, WarmupTimeout: 50, WarmupInterval: 10, WarmupAttempts: 2})
+	id, _ := putProbed(t, source, server)
+
+	b.Add(id)
+	waitFor(t, "the warm-up to end", func() bool { return warmingUp(b) == 0 })
+
+	if got := probes.Load(); got != 2 {
+		t.Fatalf("probes = %d, want 2", got)
+	}
+	if services := b.Services(); len(services) != 0 {
+		t.Fatalf("services = %v", services)
+	}
+	assertCalls(t, adapter)
+}
+
+func TestWarmupStopsWhenTheContainerStops(t *testing.T) {
+	probing := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probing <- struct{}{}
+		<-release
+	}))
+	t.Cleanup(server.Close)
+	b, source, adapter := newTestBridge(t, Config{Warmup: true, WarmupTimeout: 5000, WarmupInterval: 10, WarmupAttempts: 5})
+	id, _ := putProbed(t, source, server)
+
+	b.Add(id)
+	<-probing
+	source.SetState(id, StateStopped)
+	b.RemoveOnExit(id)
+	if got := warmingUp(b); got != 0 {
+		t.Fatalf("warming up = %d after the container stopped", got)
+	}
+	// the probe in flight succeeds after the container stopped
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+
+	if services := b.Services(); len(services) != 0 {
+		t.Fatalf("services = %v", services)
+	}
+	assertCalls(t, adapter)
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/pelletier/go-toml"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"regexp"
+	"registrator-containerd/bridge"
+	"registrator-containerd/utils"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// registryKey is the configuration file key of the registry URI argument.
+const registryKey = "registry"
+
+// reloadableFlags can be changed in the configuration file and applied on
+// SIGHUP, every other setting requires a restart.
+var reloadableFlags = map[string]bool{
+	"tags":          true,
+	"ttl":           true,
+	"ttl-refresh":   true,
+	"resync":        true,
+	"heartbeat":     true,
+	"deregister":    true,
+	"explicit":      true,
+	"cleanup":       true,
+	"redact-keys":   true,
+	"redact-values": true,
+	"log-level":     true,
+	"log-events":    true,
+
+	"ip-family":       true,
+	"cleanup-dry-run": true,
+	"cleanup-max":     true,
+	"cleanup-abort":   true,
+	"cleanup-protect": true,
+	"cleanup-grace":   true,
+	"pause-policy":    true,
+	"oom-warning":     true,
+	"flap-threshold":  true,
+	"flap-window":     true,
+	"flap-stable":     true,
+	"flap-policy":     true,
+	"adapter-timeout": true,
+	"batch-size":      true,
+	"batch-interval":  true,
+	"warmup":          true,
+	"warmup-timeout":  true,
+	"warmup-interval": true,
+	"warmup-attempts": true,
+}
+
+// fileConfig holds the settings read from the configuration file. Keys are
+// the flag names, e.g. "ttl-refresh", plus "registry" for the registry URI.
+type fileConfig struct {
+	path     string
+	values   map[string]string
+	explicit map[string]bool
+}
+
+// loadConfigFile reads a YAML or TOML configuration file, TOML is detected
+// by the .toml extension.
+func loadConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make(map[string]interface{})
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		tree, err := toml.LoadBytes(data)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		raw = tree.ToMap()
+	} else if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for key, value := range raw {
+		if key != registryKey && flag.Lookup(key) == nil {
+			return nil, fmt.Errorf("%s: unknown setting %q", path, key)
+		}
+		s, err := configValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: setting %q: %w", path, key, err)
+		}
+		values[key] = s
+	}
+	return values, nil
+}
+
+// configValue converts a configuration value to its flag representation,
+// lists become comma separated strings.
+func configValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, ","), nil
+	case map[string]interface{}:
+		return "", errors.New("nested settings are not supported")
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// newFileConfig loads the configuration file and applies it to the flags
+// that were not set on the command line.
+func newFileConfig(path string) (*fileConfig, error) {
+	values, err := loadConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &fileConfig{path: path, values: values, explicit: make(map[string]bool)}
+	flag.Visit(func(f *flag.Flag) {
+		c.explicit[f.Name] = true
+	})
+
+	for key, value := range values {
+		if key == registryKey || c.explicit[key] {
+			continue
+		}
+		if err := flag.Set(key, value); err != nil {
+			return nil, fmt.Errorf("%s: setting %q: %w", path, key, err)
+		}
+	}
+	return c, nil
+}
+
+// registryURI returns the registry URI of the configuration file.
+func (c *fileConfig) registryURI() string {
+	if c == nil {
+		return ""
+	}
+	return c.values[registryKey]
+}
+
+// reload reads the configuration file again and applies the changed
+// settings to the flags. Nothing is applied when a setting that requires a
+// restart has changed. It returns the names of the changed settings.
+func (c *fileConfig) reload() ([]string, error) {
+	values, err := loadConfigFile(c.path)
+	if err != nil {
+		return nil, err
+	}
+
+	updates := make(map[string]string)
+	var errs []error
+	for key := range mergeKeys(c.values, values) {
+		if c.explicit[key] {
+			// the command line always wins
+			continue
+		}
+		if key == registryKey {
+			if values[key] != c.values[key] {
+				errs = append(errs, fmt.Errorf("setting %q requires a restart", key))
+			}
+			continue
+		}
+		f := flag.Lookup(key)
+		value, ok := values[key]
+		if !ok {
+			// removed from the file, fall back to the default
+			value = f.DefValue
+		}
+		if value == f.Value.String() {
+			continue
+		}
+		if !reloadableFlags[key] {
+			errs = append(errs, fmt.Errorf("setting %q requires a restart", key))
+			continue
+		}
+		updates[key] = value
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	previous := make(map[string]string, len(updates))
+	changed := make([]string, 0, len(updates))
+	for key, value := range updates {
+		previous[key] = flag.Lookup(key).Value.String()
+		if err := flag.Set(key, value); err != nil {
+			restoreFlags(previous)
+			return nil, fmt.Errorf("setting %q: %w", key, err)
+		}
+		changed = append(changed, key)
+	}
+	if err := validateFlags(); err != nil {
+		restoreFlags(previous)
+		return nil, err
+	}
+
+	c.values = values
+	sort.Strings(changed)
+	return changed, nil
+}
+
+func restoreFlags(values map[string]string) {
+	for key, value := range values {
+		if err := flag.Set(key, value); err != nil {
+			utils.L.WithError(err).WithField("setting", key).Error("restore setting failed")
+		}
+	}
+}
+
+func mergeKeys(maps ...map[string]string) map[string]bool {
+	keys := make(map[string]bool)
+	for _, m := range maps {
+		for key := range m {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+// applyDeprecatedFlags sets the flags that replace deprecated ones, unless
+// they are set themselves.
+func applyDeprecatedFlags() error {
+	if *namespace == "" {
+		return nil
+	}
+	utils.L.Warn("-namespace is deprecated, use -namespaces")
+	replaced := false
+	flag.Visit(func(f *flag.Flag) {
+		replaced = replaced || f.Name == "namespaces"
+	})
+	if replaced {
+		return nil
+	}
+	return flag.Set("namespaces", *namespace)
+}
+
+// validateFlags checks the settings that depend on each other.
+func validateFlags() error {
+	if (*refreshTtl == 0 && *refreshInterval > 0) || (*refreshTtl > 0 && *refreshInterval == 0) {
+		return errors.New("-ttl and -ttl-refresh must be specified together or not at all")
+	} else if *refreshTtl > 0 && *refreshTtl <= *refreshInterval {
+		return errors.New("-ttl must be greater than -ttl-refresh")
+	}
+
+	if *cleanupMax < 0 {
+		return errors.New("-cleanup-max must not be negative")
+	}
+	if *cleanupAbort < 0 || *cleanupAbort > 100 {
+		return errors.New("-cleanup-abort must be a percentage")
+	}
+	if _, err := regexp.Compile(*cleanupProtect); err != nil {
+		return fmt.Errorf("-cleanup-protect: %w", err)
+	}
+	if *cleanupGrace < 0 {
+		return errors.New("-cleanup-grace must not be negative")
+	}
+
+	if *heartbeatInterval < 0 {
+		return errors.New("-heartbeat must not be negative")
+	}
+
+	if *retryInterval <= 0 {
+		return errors.New("-retry-interval must be greater than 0")
+	}
+
+	if *readinessPolicy != bridge.ReadinessDeregister && *readinessPolicy != bridge.ReadinessCritical {
+		return fmt.Errorf("-readiness-policy must be %s or %s", bridge.ReadinessDeregister, bridge.ReadinessCritical)
+	}
+	if *kubeletPollInterval <= 0 {
+		return errors.New("-kubelet-poll-interval must be greater than 0")
+	}
+
+	if err := bridge.ValidateIPFamily(*ipFamily); err != nil {
+		return err
+	}
+	if err := bridge.ValidatePausePolicy(*pausePolicy); err != nil {
+		return err
+	}
+	if err := bridge.ValidateFlapPolicy(*flapPolicy); err != nil {
+		return err
+	}
+	if *flapThreshold < 0 {
+		return errors.New("-flap-threshold must not be negative")
+	}
+	if *flapThreshold > 0 && (*flapWindow <= 0 || *flapStable <= 0) {
+		return errors.New("-flap-window and -flap-stable must be positive")
+	}
+
+	if *rateLimit < 0 {
+		return errors.New("-rate-limit must not be negative")
+	}
+	if *rateLimit > 0 && *rateBurst < 1 {
+		return errors.New("-rate-burst must be at least 1")
+	}
+	if *batchSize < 1 {
+		return errors.New("-batch-size must be at least 1")
+	}
+	if *batchInterval <= 0 {
+		return errors.New("-batch-interval must be greater than 0")
+	}
+	if *adapterTimeout < 0 {
+		return errors.New("-adapter-timeout must not be negative")
+	}
+	if *breakerFailures < 0 {
+		return errors.New("-breaker-failures must not be negative")
+	}
+	if *breakerFailures > 0 && *breakerCooldown <= 0 {
+		return errors.New("-breaker-cooldown must be greater than 0")
+	}
+
+	if *warmupTimeout <= 0 || *warmupInterval <= 0 || *warmupAttempts <= 0 {
+		return errors.New("-warmup-timeout, -warmup-interval and -warmup-attempts must be greater than 0")
+	}
+
+	if len(splitList(*namespaceList)) == 0 {
+		return errors.New("-namespaces must not be empty")
+	}
+	return nil
+}
+
+// splitList splits a comma separated flag value, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func bridgeConfig() bridge.Config {
+	return bridge.Config{
+		HostIp:          *hostIp,
+		Internal:        *internal,
+		Explicit:        *explicit,
+		UseIpFromLabel:  *useIpFromLabel,
+		ForceTags:       *forceTags,
+		RefreshTtl:      *refreshTtl,
+		RefreshInterval: *refreshInterval,
+		DeregisterCheck: *deregister,
+		Cleanup:         *cleanup,
+		CleanupDryRun:   *cleanupDryRun,
+		CleanupMax:      *cleanupMax,
+		CleanupAbort:    *cleanupAbort,
+		CleanupProtect:  *cleanupProtect,
+		CleanupGrace:    *cleanupGrace,
+		DataCenterId:    *dataCenterId,
+		IPFamily:        *ipFamily,
+		PausePolicy:     *pausePolicy,
+		OOMWarning:      *oomWarning,
+		FlapThreshold:   *flapThreshold,
+		FlapWindow:      *flapWindow,
+		FlapStable:      *flapStable,
+		FlapPolicy:      *flapPolicy,
+		RateLimit:       *rateLimit,
+		RateBurst:       *rateBurst,
+		BreakerFailures: *breakerFailures,
+		BreakerCooldown: *breakerCooldown,
+		AdapterTimeout:  *adapterTimeout,
+		BatchSize:       *batchSize,
+		BatchInterval:   *batchInterval,
+		Warmup:          *warmup,
+		WarmupTimeout:   *warmupTimeout,
+		WarmupInterval:  *warmupInterval,
+		WarmupAttempts:  *warmupAttempts,
+		Version:         Version,
+		InstanceId:      *instanceId,
+	}
+}
+
+// eventLogging is -log-events for the event handlers, the flag itself is
+// only read and written by the main and the reload goroutine.
+var eventLogging atomic.Bool
+
+// applyLogging applies the logging and redaction settings.
+func applyLogging() error {
+	if err := utils.SetLevel(*logLevel); err != nil {
+		return err
+	}
+	if err := utils.SetFormat(*logFormat); err != nil {
+		return err
+	}
+	redactor, err := bridge.NewRedactor(*redactKeys, *redactValues)
+	if err != nil {
+		return err
+	}
+	bridge.SetRedactor(redactor)
+	eventLogging.Store(*logEvents)
+	return nil
+}
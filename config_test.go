@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"registrator-containerd/bridge"
+	"registrator-containerd/utils"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestReloadAppliesLogEventsToRunningHandlers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registrator.yaml")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("log-events: false\n")
+	fileConf, err := newFileConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyLogging(); err != nil {
+		t.Fatal(err)
+	}
+	output := utils.L.Logger.Out
+	utils.L.Logger.SetOutput(io.Discard)
+	t.Cleanup(func() { utils.L.Logger.SetOutput(output) })
+
+	// an event handler reads the setting while it is reloaded
+	event := &bridge.ContainerEvent{Topic: "/test"}
+	running := make(chan struct{})
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		close(running)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				logEvent(event)
+				runtime.Gosched()
+			}
+		}
+	}()
+	<-running
+
+	write("log-events: true\n")
+	changed, err := fileConf.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyLogging(); err != nil {
+		t.Fatal(err)
+	}
+	close(done)
+	<-stopped
+
+	if want := []string{"log-events"}; !reflect.DeepEqual(changed, want) {
+		t.Fatalf("changed = %q, want %q", changed, want)
+	}
+	if !eventLogging.Load() {
+		t.Fatal("-log-events not applied")
+	}
+}
+
+// keepFlags restores the flags a test changes when it ends. The others are
+// not set, newFileConfig would take them for command line flags.
+func keepFlags(t *testing.T) {
+	values := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	t.Cleanup(func() {
+		changed := make(map[string]string)
+		flag.VisitAll(func(f *flag.Flag) {
+			if f.Value.String() != values[f.Name] {
+				changed[f.Name] = values[f.Name]
+			}
+		})
+		restoreFlags(changed)
+	})
+}
+
+func writeConfig(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadAppliesBridgeSettings(t *testing.T) {
+	keepFlags(t)
+	path := filepath.Join(t.TempDir(), "registrator.yaml")
+	writeConfig(t, path, "resync: 60\n")
+	fileConf, err := newFileConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeConfig(t, path, "resync: 60\npause-policy: deregister\nwarmup-timeout: 250\n")
+	changed, err := fileConf.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"pause-policy", "warmup-timeout"}; !reflect.DeepEqual(changed, want) {
+		t.Fatalf("changed = %q, want %q", changed, want)
+	}
+	if config := bridgeConfig(); config.PausePolicy != bridge.PauseDeregister || config.WarmupTimeout != 250 {
+		t.Fatalf("pause policy = %q, warmup timeout = %d", config.PausePolicy, config.WarmupTimeout)
+	}
+}
+
+func TestReloadRejectsSettingsThatRequireARestart(t *testing.T) {
+	keepFlags(t)
+	path := filepath.Join(t.TempDir(), "registrator.yaml")
+	writeConfig(t, path, "registry: consul://127.0.0.1:8500\n")
+	fileConf, err := newFileConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := *forceTags
+
+	writeConfig(t, path, "registry: consul://127.0.0.1:8500\ntags: reloaded\nrate-limit: 5\n")
+	changed, err := fileConf.reload()
+	if err == nil || !strings.Contains(err.Error(), `setting "rate-limit" requires a restart`) {
+		t.Fatalf("changed = %q, err = %v, want a restart error", changed, err)
+	}
+	// nothing is applied, not even the settings that can be reloaded
+	if *forceTags != tags {
+		t.Fatalf("tags = %q, want %q", *forceTags, tags)
+	}
+	if got := fileConf.values; !reflect.DeepEqual(got, map[string]string{registryKey: "consul://127.0.0.1:8500"}) {
+		t.Fatalf("values = %q", got)
+	}
+}
@@ -1,10 +1,11 @@
 package consul
 
 import (
+	"context"
 	"fmt"
 	"github.com/hashicorp/go-cleanhttp"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/url"
 	"os"
 	"runtime"
@@ -13,10 +14,17 @@ import (
 
 	consulapi "github.com/hashicorp/consul/api"
 	"registrator-containerd/bridge"
+	"registrator-containerd/utils"
 )
 
 const DefaultInterval = "10s"
 
+// statusCheckTTL keeps the status check of SetStatus from expiring before
+// the bridge clears it.
+const statusCheckTTL = "8760h"
+
+var logger = utils.L.WithField("adapter", "consul")
+
 func init() {
 	f := new(Factory)
 	bridge.Register(f, "consul")
@@ -33,9 +41,13 @@ func (r *ConsulAdapter) interpolateService(script string, service *bridge.Servic
 type Factory struct{}
 
 func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
+	return bridge.AdapterV1(f.NewV2(uri))
+}
+
+func (f *Factory) NewV2(uri *url.URL) bridge.RegistryAdapterV2 {
 	localUri, err := getUrlFromLocalFile()
 	if err == nil && localUri != nil {
-		log.Println("use localUri: " + localUri.String())
+		logger.WithField("uri", localUri.String()).Info("use local uri")
 		uri = localUri
 	}
 
@@ -52,7 +64,7 @@ func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
 		}
 		tlsConfig, err := consulapi.SetupTLSConfig(tlsConfigDesc)
 		if err != nil {
-			log.Fatal("Cannot set up Consul TLSConfig", err)
+			logger.WithError(err).Fatal("cannot set up consul TLSConfig")
 		}
 		config.Scheme = "https"
 		transport := cleanhttp.DefaultPooledTransport()
@@ -64,7 +76,7 @@ func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
 	}
 	client, err := consulapi.NewClient(config)
 	if err != nil {
-		log.Fatal("consul: ", uri.Scheme)
+		logger.WithError(err).WithField("scheme", uri.Scheme).Fatal("cannot create consul client")
 	}
 	return &ConsulAdapter{client: client, config: config}
 }
@@ -74,25 +86,31 @@ type ConsulAdapter struct {
 	config *consulapi.Config
 }
 
-func (r *ConsulAdapter) RegisterAgentNode(dataCenterId string, hostIp string) (string, error) {
+// Capabilities: consul expires services with check_ttl checks of their own,
+// Refresh does nothing.
+func (r *ConsulAdapter) Capabilities() bridge.Capabilities {
+	return bridge.Capabilities{Maintenance: true, Status: true}
+}
+
+func (r *ConsulAdapter) RegisterAgentNode(ctx context.Context, agent bridge.Agent) (string, error) {
 	return "", nil
 }
 
 // Ping will try to connect to consul by attempting to retrieve the current leader.
-func (r *ConsulAdapter) Ping(agentId string) error {
+func (r *ConsulAdapter) Ping(ctx context.Context, agentId string) error {
 	r.refreshConsulAdapter()
 
 	status := r.client.Status()
-	leader, err := status.Leader()
+	leader, err := status.LeaderWithQueryOptions((&consulapi.QueryOptions{}).WithContext(ctx))
 	if err != nil {
 		return err
 	}
-	log.Println("consul: current leader ", leader)
+	logger.WithField("leader", leader).Debug("current leader")
 
 	return nil
 }
 
-func (r *ConsulAdapter) Register(service *bridge.Service) error {
+func (r *ConsulAdapter) Register(ctx context.Context, service *bridge.Service) error {
 	r.refreshConsulAdapter()
 
 	registration := new(consulapi.AgentServiceRegistration)
@@ -101,12 +119,55 @@ func (r *ConsulAdapter) Register(service *bridge.Service) error {
 	registration.Port = service.Port
 	registration.Tags = service.Tags
 	registration.Address = service.IP
+	registration.TaggedAddresses = taggedAddresses(service)
 	registration.Check = r.buildCheck(service)
 	registration.Meta = service.Attrs
 
 	//s,_:=json.Marshal(service)
 	//log.Println(string(s))
-	return r.client.Agent().ServiceRegister(registration)
+	return rejected(r.client.Agent().ServiceRegisterOpts(registration, consulapi.ServiceRegisterOpts{}.WithContext(ctx)))
+}
+
+// Update registers the service again, consul replaces the definition of a
+// registered service.
+func (r *ConsulAdapter) Update(ctx context.Context, service *bridge.Service) error {
+	return r.Register(ctx, service)
+}
+
+// taggedAddresses advertises the address of every ip family of the service
+// as lan_ipv4 and lan_ipv6.
+func taggedAddresses(service *bridge.Service) map[string]consulapi.ServiceAddress {
+	addresses := make(map[string]consulapi.ServiceAddress)
+	for _, address := range service.IPs {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			continue
+		}
+		tag := "lan_ipv6"
+		if ip.To4() != nil {
+			tag = "lan_ipv4"
+		}
+		if _, ok := addresses[tag]; !ok {
+			addresses[tag] = consulapi.ServiceAddress{Address: address, Port: service.Port}
+		}
+	}
+	if len(addresses) == 0 {
+		return nil
+	}
+	return addresses
+}
+
+// serviceAddresses returns the address of the service followed by the
+// addresses of the other ip families, the reverse of taggedAddresses.
+func serviceAddresses(service *consulapi.AgentService) []string {
+	addresses := []string{service.Address}
+	for _, tag := range []string{"lan_ipv4", "lan_ipv6"} {
+		address, ok := service.TaggedAddresses[tag]
+		if ok && address.Address != service.Address {
+			addresses = append(addresses, address.Address)
+		}
+	}
+	return addresses
 }
 
 func (r *ConsulAdapter) buildCheck(service *bridge.Service) *consulapi.AgentServiceCheck {
@@ -115,7 +176,7 @@ func (r *ConsulAdapter) buildCheck(service *bridge.Service) *consulapi.AgentServ
 		check.Status = status
 	}
 	if path := service.Attrs["check_http"]; path != "" {
-		check.HTTP = fmt.Sprintf("http://%s:%d%s", service.IP, service.Port, path)
+		check.HTTP = "http://" + hostPort(service) + path
 		if timeout := service.Attrs["check_timeout"]; timeout != "" {
 			check.Timeout = timeout
 		}
@@ -123,7 +184,7 @@ func (r *ConsulAdapter) buildCheck(service *bridge.Service) *consulapi.AgentServ
 			check.Method = method
 		}
 	} else if path := service.Attrs["check_https"]; path != "" {
-		check.HTTP = fmt.Sprintf("https://%s:%d%s", service.IP, service.Port, path)
+		check.HTTP = "https://" + hostPort(service) + path
 		if timeout := service.Attrs["check_timeout"]; timeout != "" {
 			check.Timeout = timeout
 		}
@@ -137,12 +198,12 @@ func (r *ConsulAdapter) buildCheck(service *bridge.Service) *consulapi.AgentServ
 	} else if ttl := service.Attrs["check_ttl"]; ttl != "" {
 		check.TTL = ttl
 	} else if tcp := service.Attrs["check_tcp"]; tcp != "" {
-		check.TCP = fmt.Sprintf("%s:%d", service.IP, service.Port)
+		check.TCP = hostPort(service)
 		if timeout := service.Attrs["check_timeout"]; timeout != "" {
 			check.Timeout = timeout
 		}
 	} else if grpc := service.Attrs["check_grpc"]; grpc != "" {
-		check.GRPC = fmt.Sprintf("%s:%d", service.IP, service.Port)
+		check.GRPC = hostPort(service)
 		if timeout := service.Attrs["check_timeout"]; timeout != "" {
 			check.Timeout = timeout
 		}
@@ -168,24 +229,85 @@ func (r *ConsulAdapter) buildCheck(service *bridge.Service) *consulapi.AgentServ
 	return check
 }
 
-func (r *ConsulAdapter) Deregister(service *bridge.Service) error {
+// hostPort returns the address of the service, IPv6 addresses in brackets.
+func hostPort(service *bridge.Service) string {
+	return net.JoinHostPort(service.IP, strconv.Itoa(service.Port))
+}
+
+func (r *ConsulAdapter) Deregister(ctx context.Context, service *bridge.Service) error {
 	//s,_:=json.Marshal(service)
 	//log.Println(string(s))
 	r.refreshConsulAdapter()
 
-	return r.client.Agent().ServiceDeregister(service.ID)
+	return rejected(r.client.Agent().ServiceDeregisterOpts(service.ID, (&consulapi.QueryOptions{}).WithContext(ctx)))
+}
+
+// Maintenance puts a service into maintenance mode, consul reports it as
+// critical until maintenance is disabled again. The consul client cannot
+// cancel the request, ctx is only checked before it is sent.
+func (r *ConsulAdapter) Maintenance(ctx context.Context, service *bridge.Service, enable bool, reason string) error {
+	r.refreshConsulAdapter()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if enable {
+		return rejected(r.client.Agent().EnableServiceMaintenance(service.ID, reason))
+	}
+	return rejected(r.client.Agent().DisableServiceMaintenance(service.ID))
+}
+
+// SetStatus reports a status in an extra TTL check of the service, the note
+// is its output. The check is removed when the service passes again.
+func (r *ConsulAdapter) SetStatus(ctx context.Context, service *bridge.Service, status string, note string) error {
+	r.refreshConsulAdapter()
+
+	checkId := "registrator:status:" + service.ID
+	options := (&consulapi.QueryOptions{}).WithContext(ctx)
+	if status == bridge.HealthPassing {
+		return rejected(r.client.Agent().CheckDeregisterOpts(checkId, options))
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := r.client.Agent().CheckRegister(&consulapi.AgentCheckRegistration{
+		ID:        checkId,
+		Name:      "registrator status",
+		ServiceID: service.ID,
+		AgentServiceCheck: consulapi.AgentServiceCheck{
+			TTL:    statusCheckTTL,
+			Status: status,
+		},
+	})
+	if err != nil {
+		return rejected(err)
+	}
+	return rejected(r.client.Agent().UpdateTTLOpts(checkId, note, status, options))
+}
+
+// rejected marks the error of a request consul answered with a client
+// error, e.g. an invalid check or an unknown service.
+func rejected(err error) error {
+	if err == nil {
+		return nil
+	}
+	var code int
+	if _, scanErr := fmt.Sscanf(err.Error(), "Unexpected response code: %d", &code); scanErr == nil && code >= 400 && code < 500 {
+		return fmt.Errorf("%w: %w", bridge.ErrRejected, err)
+	}
+	return err
 }
 
-func (r *ConsulAdapter) Refresh(service *bridge.Service) error {
+func (r *ConsulAdapter) Refresh(ctx context.Context, service *bridge.Service) error {
 	r.refreshConsulAdapter()
 
 	return nil
 }
 
-func (r *ConsulAdapter) Services(agentId string) ([]*bridge.Service, error) {
+func (r *ConsulAdapter) Services(ctx context.Context, agentId string) ([]*bridge.Service, error) {
 	r.refreshConsulAdapter()
 
-	services, err := r.client.Agent().Services()
+	services, err := r.client.Agent().ServicesWithFilterOpts("", (&consulapi.QueryOptions{}).WithContext(ctx))
 	if err != nil {
 		return []*bridge.Service{}, err
 	}
@@ -193,11 +315,13 @@ func (r *ConsulAdapter) Services(agentId string) ([]*bridge.Service, error) {
 	i := 0
 	for _, v := range services {
 		s := &bridge.Service{
-			ID:   v.ID,
-			Name: v.Service,
-			Port: v.Port,
-			Tags: v.Tags,
-			IP:   v.Address,
+			ID:    v.ID,
+			Name:  v.Service,
+			Port:  v.Port,
+			Tags:  v.Tags,
+			IP:    v.Address,
+			IPs:   serviceAddresses(v),
+			Attrs: v.Meta,
 		}
 		out[i] = s
 		i++
@@ -219,12 +343,12 @@ func (r *ConsulAdapter) refreshConsulAdapter() {
 	newConfig.Address = localUri.Host
 	newClient, err := consulapi.NewClient(newConfig)
 	if err != nil {
-		log.Fatal("consul: ", localUri.Scheme)
+		logger.WithError(err).WithField("scheme", localUri.Scheme).Fatal("cannot create consul client")
 	}
 	r.config = newConfig
 	r.client = newClient
 
-	log.Println("refreshConsulAdapter: " + r.config.Address)
+	logger.WithField("address", r.config.Address).Info("consul address refreshed")
 }
 
 // windows 环境下hostNetwork模式无法访问 127.0.0.1的本机容器，需要通过挂载文件方式读取consul-client预先写入的地址
@@ -236,14 +360,14 @@ func getUrlFromLocalFile() (*url.URL, error) {
 	agentUrlFile := "C:/host/etc/consul/agent_url"
 	fileContent, err := ioutil.ReadFile(agentUrlFile)
 	if err != nil {
-		log.Println("ReadFile: " + err.Error())
+		logger.WithError(err).WithField("file", agentUrlFile).Warn("read agent url file failed")
 		return nil, err
 	}
 	adapterUri := strings.TrimSpace(string(fileContent))
 
 	uri, err := url.Parse(adapterUri)
 	if err != nil {
-		log.Println("Parse: " + err.Error())
+		logger.WithError(err).WithField("file", agentUrlFile).Warn("parse agent url failed")
 		return nil, err
 	}
 
@@ -0,0 +1,47 @@
+package consul
+
+import (
+	"reflect"
+	"registrator-containerd/bridge"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestChecksOfIPv6ServicesBracketTheAddress(t *testing.T) {
+	r := new(ConsulAdapter)
+	for attr, want := range map[string]string{
+		"check_http":  "http://[fd00::2]:8080/health",
+		"check_https": "https://[fd00::2]:8080/health",
+		"check_tcp":   "[fd00::2]:8080",
+	} {
+		service := &bridge.Service{IP: "fd00::2", Port: 8080, Attrs: map[string]string{attr: "/health"}}
+		check := r.buildCheck(service)
+		if got := check.HTTP + check.TCP; got != want {
+			t.Fatalf("%s = %q, want %q", attr, got, want)
+		}
+	}
+
+	// IPv4 addresses are left alone
+	check := r.buildCheck(&bridge.Service{IP: "10.0.0.2", Port: 8080, Attrs: map[string]string{"check_http": "/health"}})
+	if want := "http://10.0.0.2:8080/health"; check.HTTP != want {
+		t.Fatalf("check_http = %q, want %q", check.HTTP, want)
+	}
+}
+
+func TestTaggedAddressesAdvertiseEveryFamily(t *testing.T) {
+	service := &bridge.Service{IP: "fd00::2", Port: 8080, IPs: []string{"fd00::2", "10.0.0.2"}}
+
+	tagged := taggedAddresses(service)
+	want := map[string]consulapi.ServiceAddress{
+		"lan_ipv6": {Address: "fd00::2", Port: 8080},
+		"lan_ipv4": {Address: "10.0.0.2", Port: 8080},
+	}
+	if !reflect.DeepEqual(tagged, want) {
+		t.Fatalf("tagged addresses = %+v, want %+v", tagged, want)
+	}
+	registered := &consulapi.AgentService{Address: service.IP, TaggedAddresses: tagged}
+	if got := serviceAddresses(registered); !reflect.DeepEqual(got, service.IPs) {
+		t.Fatalf("addresses = %q, want %q", got, service.IPs)
+	}
+}
@@ -0,0 +1,348 @@
+package cri
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/containerd/errdefs"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+	"registrator-containerd/bridge"
+	"registrator-containerd/pkg/ctrclient"
+	"registrator-containerd/utils"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultEndpoint is the CRI socket of containerd, CRI-O listens on
+	// unix:///var/run/crio/crio.sock.
+	DefaultEndpoint = "unix:///run/containerd/containerd.sock"
+
+	DefaultPollInterval = 5 * time.Second
+)
+
+var logger = utils.L.WithField("runtime", "cri")
+
+// Source reads containers through the Kubernetes CRI runtime service, which
+// is served by containerd as well as CRI-O. It builds the same containers as
+// bridge.ContainerdSource from the CRI status responses.
+type Source struct {
+	conn         *grpc.ClientConn
+	client       runtimeapi.RuntimeServiceClient
+	pollInterval time.Duration
+	// CNIResultsDir is the libcni cache the network attachments of pods are
+	// read from.
+	CNIResultsDir string
+}
+
+// NewSource connects to a CRI endpoint, either a unix:// URI or a socket
+// path. Events are polled every pollInterval when the runtime does not
+// implement GetContainerEvents.
+func NewSource(endpoint string, pollInterval time.Duration) (*Source, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "unix://" + endpoint
+	}
+	if pollInterval <= 0 {
+		pollInterval = DefaultPollInterval
+	}
+	conn, err := grpc.Dial(endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("connect to cri endpoint %s: %w", endpoint, err)
+	}
+	return &Source{
+		conn:          conn,
+		client:        runtimeapi.NewRuntimeServiceClient(conn),
+		pollInterval:  pollInterval,
+		CNIResultsDir: ctrclient.DefaultCNIResultsDir,
+	}, nil
+}
+
+func (s *Source) Close() error {
+	return s.conn.Close()
+}
+
+func (s *Source) Ping(ctx context.Context) error {
+	_, err := s.client.Version(ctx, &runtimeapi.VersionRequest{})
+	return err
+}
+
+func (s *Source) Version(ctx context.Context) (string, error) {
+	response, err := s.client.Version(ctx, &runtimeapi.VersionRequest{})
+	if err != nil {
+		return "", err
+	}
+	return response.RuntimeName + " " + response.RuntimeVersion, nil
+}
+
+func (s *Source) List(ctx context.Context) ([]string, error) {
+	response, err := s.client.ListContainers(ctx, &runtimeapi.ListContainersRequest{})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(response.Containers))
+	for i, container := range response.Containers {
+		ids[i] = container.Id
+	}
+	return ids, nil
+}
+
+func (s *Source) Status(ctx context.Context, containerId string) (bridge.ContainerState, error) {
+	response, err := s.client.ContainerStatus(ctx, &runtimeapi.ContainerStatusRequest{ContainerId: containerId})
+	if err != nil {
+		return bridge.StateUnknown, fromGRPC(err)
+	}
+	return containerState(response.Status.GetState()), nil
+}
+
+func containerState(state runtimeapi.ContainerState) bridge.ContainerState {
+	switch state {
+	case runtimeapi.ContainerState_CONTAINER_CREATED:
+		return bridge.StateCreated
+	case runtimeapi.ContainerState_CONTAINER_RUNNING:
+		return bridge.StateRunning
+	case runtimeapi.ContainerState_CONTAINER_EXITED:
+		return bridge.StateStopped
+	}
+	return bridge.StateUnknown
+}
+
+// verboseInfo is the part of the verbose container status info the source
+// uses. containerd reports the CRI container config and the OCI spec, CRI-O
+// only the OCI spec.
+type verboseInfo struct {
+	SandboxID string `json:"sandboxID"`
+	Config    *struct {
+		Envs []ctrclient.EnvMetadata `json:"envs"`
+	} `json:"config"`
+	RuntimeSpec *ctrclient.ContainerSpec `json:"runtimeSpec"`
+}
+
+func (s *Source) Inspect(ctx context.Context, containerId string) (*bridge.K8SScheduleContainer, error) {
+	list, err := s.client.ListContainers(ctx, &runtimeapi.ListContainersRequest{
+		Filter: &runtimeapi.ContainerFilter{Id: containerId},
+	})
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("list container failed %s", containerId), err)
+	}
+	if len(list.Containers) == 0 {
+		// sandboxes are not listed as containers
+		return nil, nil
+	}
+	container := list.Containers[0]
+	if container.Labels[ctrclient.PodUid] == "" {
+		return nil, nil
+	}
+
+	containerStatus, err := s.client.ContainerStatus(ctx, &runtimeapi.ContainerStatusRequest{
+		ContainerId: containerId,
+		Verbose:     true,
+	})
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("get container status failed %s", containerId), fromGRPC(err))
+	}
+
+	sandboxStatus, err := s.client.PodSandboxStatus(ctx, &runtimeapi.PodSandboxStatusRequest{
+		PodSandboxId: container.PodSandboxId,
+	})
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("get container sandbox failed %s", container.PodSandboxId), fromGRPC(err))
+	}
+
+	k8sContainer, err := newContainer(container, containerStatus, sandboxStatus)
+	if err != nil {
+		return nil, err
+	}
+	k8sContainer.Networks, err = ctrclient.ReadCNIResults(s.CNIResultsDir, container.PodSandboxId)
+	if err != nil {
+		// the services are registered on the sandbox IP
+		logger.WithError(err).WithField("container", containerId).Warn("read cni results failed, using the sandbox ip")
+	}
+	return k8sContainer, nil
+}
+
+func newContainer(container *runtimeapi.Container, containerStatus *runtimeapi.ContainerStatusResponse, sandboxStatus *runtimeapi.PodSandboxStatusResponse) (*bridge.K8SScheduleContainer, error) {
+	var info verboseInfo
+	if data := containerStatus.Info["info"]; data != "" {
+		if err := json.Unmarshal([]byte(data), &info); err != nil {
+			return nil, errors.Join(fmt.Errorf("unmarshal container info failed %s", container.Id), err)
+		}
+	}
+
+	status := containerStatus.Status
+	var containerMeta ctrclient.ContainerMetadata
+	containerMeta.Metadata.ID = container.Id
+	containerMeta.Metadata.Name = status.GetMetadata().GetName()
+	containerMeta.Metadata.SandBoxID = container.PodSandboxId
+	containerMeta.Metadata.LogPath = status.LogPath
+	containerMeta.Metadata.Config.Labels = status.Labels
+	containerMeta.Metadata.Config.Annotations = status.Annotations
+
+	var containerSpec ctrclient.ContainerSpec
+	if info.RuntimeSpec != nil {
+		containerSpec = *info.RuntimeSpec
+	}
+	if info.Config != nil {
+		containerMeta.Metadata.Config.Envs = info.Config.Envs
+	} else {
+		for _, env := range containerSpec.Process.Env {
+			key, value, _ := strings.Cut(env, "=")
+			containerMeta.AddEnv(key, value)
+		}
+	}
+	if len(containerSpec.Process.Env) == 0 {
+		for _, env := range containerMeta.Metadata.Config.Envs {
+			containerSpec.Process.Env = append(containerSpec.Process.Env, env.Key+"="+env.Value)
+		}
+	}
+	containerMeta.Metadata.Config.HostName = containerSpec.GetEnv("HOSTNAME")
+
+	var sandboxMeta ctrclient.ContainerMetadata
+	sandboxMeta.Metadata.ID = container.PodSandboxId
+	sandboxMeta.Metadata.Name = sandboxStatus.Status.GetMetadata().GetName()
+	sandboxMeta.Metadata.IP = sandboxStatus.Status.GetNetwork().GetIp()
+	for _, ip := range sandboxStatus.Status.GetNetwork().GetAdditionalIps() {
+		sandboxMeta.Metadata.AdditionalIPs = append(sandboxMeta.Metadata.AdditionalIPs, ip.GetIp())
+	}
+	sandboxMeta.Metadata.Config.Labels = sandboxStatus.Status.GetLabels()
+	sandboxMeta.Metadata.Config.Annotations = sandboxStatus.Status.GetAnnotations()
+
+	return &bridge.K8SScheduleContainer{
+		ID:                container.Id,
+		Name:              containerMeta.Metadata.Name,
+		Labels:            status.Labels,
+		ContainerMetadata: &containerMeta,
+		ContainerSpec:     &containerSpec,
+		SandBoxMetadata:   &sandboxMeta,
+	}, nil
+}
+
+// Events streams GetContainerEvents, or polls the container list when the
+// runtime does not implement it.
+func (s *Source) Events(ctx context.Context) (<-chan *bridge.ContainerEvent, <-chan error) {
+	out := make(chan *bridge.ContainerEvent)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(out)
+
+		stream, err := s.client.GetContainerEvents(ctx, &runtimeapi.GetEventsRequest{})
+		for err == nil {
+			var response *runtimeapi.ContainerEventResponse
+			response, err = stream.Recv()
+			if err != nil {
+				break
+			}
+			if !send(ctx, out, containerEvent(response)) {
+				return
+			}
+		}
+
+		if status.Code(err) == codes.Unimplemented {
+			logger.WithField("interval", s.pollInterval).Info("runtime does not stream container events, polling")
+			s.poll(ctx, out)
+			return
+		}
+		errs <- err
+	}()
+	return out, errs
+}
+
+func containerEvent(response *runtimeapi.ContainerEventResponse) *bridge.ContainerEvent {
+	event := &bridge.ContainerEvent{
+		Type:        bridge.EventOther,
+		Topic:       response.ContainerEventType.String(),
+		ContainerID: response.ContainerId,
+		Timestamp:   time.Unix(0, response.CreatedAt),
+		Payload:     response,
+	}
+	switch response.ContainerEventType {
+	case runtimeapi.ContainerEventType_CONTAINER_STARTED_EVENT:
+		event.Type = bridge.EventStart
+	case runtimeapi.ContainerEventType_CONTAINER_STOPPED_EVENT, runtimeapi.ContainerEventType_CONTAINER_DELETED_EVENT:
+		event.Type = bridge.EventDelete
+	}
+	return event
+}
+
+// poll emits start and delete events for the containers that started or
+// stopped between two listings.
+func (s *Source) poll(ctx context.Context, out chan<- *bridge.ContainerEvent) {
+	running, err := s.running(ctx)
+	if err != nil {
+		logger.WithError(err).Warn("list containers failed")
+	}
+
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current, err := s.running(ctx)
+		if err != nil {
+			logger.WithError(err).Warn("list containers failed")
+			continue
+		}
+		for id := range current {
+			if !running[id] && !send(ctx, out, pollEvent(bridge.EventStart, runtimeapi.ContainerEventType_CONTAINER_STARTED_EVENT, id)) {
+				return
+			}
+		}
+		for id := range running {
+			if !current[id] && !send(ctx, out, pollEvent(bridge.EventDelete, runtimeapi.ContainerEventType_CONTAINER_STOPPED_EVENT, id)) {
+				return
+			}
+		}
+		running = current
+	}
+}
+
+func (s *Source) running(ctx context.Context) (map[string]bool, error) {
+	response, err := s.client.ListContainers(ctx, &runtimeapi.ListContainersRequest{
+		Filter: &runtimeapi.ContainerFilter{
+			State: &runtimeapi.ContainerStateValue{State: runtimeapi.ContainerState_CONTAINER_RUNNING},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	running := make(map[string]bool, len(response.Containers))
+	for _, container := range response.Containers {
+		running[container.Id] = true
+	}
+	return running, nil
+}
+
+func pollEvent(eventType bridge.EventType, topic runtimeapi.ContainerEventType, containerId string) *bridge.ContainerEvent {
+	return &bridge.ContainerEvent{
+		Type:        eventType,
+		Topic:       topic.String(),
+		ContainerID: containerId,
+		Timestamp:   time.Now(),
+	}
+}
+
+func send(ctx context.Context, out chan<- *bridge.ContainerEvent, event *bridge.ContainerEvent) bool {
+	select {
+	case out <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// fromGRPC maps NotFound to errdefs.ErrNotFound like the containerd client.
+func fromGRPC(err error) error {
+	if status.Code(err) == codes.NotFound {
+		return fmt.Errorf("%s: %w", status.Convert(err).Message(), errdefs.ErrNotFound)
+	}
+	return err
+}
@@ -0,0 +1,222 @@
+package cri
+
+import (
+	"context"
+	"github.com/containerd/errdefs"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+	"os"
+	"path/filepath"
+	"reflect"
+	"registrator-containerd/bridge"
+	"registrator-containerd/pkg/ctrclient"
+	"testing"
+	"time"
+)
+
+// newTestSource serves runtime on a unix socket and connects a source to it.
+func newTestSource(t *testing.T, runtime *FakeRuntime, pollInterval time.Duration) *Source {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "cri.sock")
+	if err := runtime.Serve(socket); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(runtime.Stop)
+
+	source, err := NewSource(socket, pollInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { source.Close() })
+	source.CNIResultsDir = t.TempDir()
+	return source
+}
+
+// addPod adds a sandbox and a running container of the pod name.
+func addPod(runtime *FakeRuntime, name string, env []string) string {
+	sandboxId := "sandbox-" + name
+	labels := map[string]string{
+		ctrclient.PodUid:        "uid-" + name,
+		ctrclient.PodName:       name,
+		ctrclient.PodNamespace:  "default",
+		ctrclient.ContainerName: name,
+	}
+	runtime.AddSandbox(&runtimeapi.PodSandboxStatus{
+		Id:       sandboxId,
+		Metadata: &runtimeapi.PodSandboxMetadata{Name: name, Uid: "uid-" + name, Namespace: "default"},
+		State:    runtimeapi.PodSandboxState_SANDBOX_READY,
+		Network: &runtimeapi.PodSandboxNetworkStatus{
+			Ip:            "10.0.0.2",
+			AdditionalIps: []*runtimeapi.PodIP{{Ip: "fd00::2"}},
+		},
+		Labels: labels,
+	})
+	runtime.AddContainer(&runtimeapi.Container{
+		Id:           "c-" + name,
+		PodSandboxId: sandboxId,
+		Metadata:     &runtimeapi.ContainerMetadata{Name: name},
+		State:        runtimeapi.ContainerState_CONTAINER_RUNNING,
+		Labels:       labels,
+		Annotations: map[string]string{
+			ctrclient.ContainerPortsAnnotation: `[{"name":"http","containerPort":8080,"protocol":"TCP"}]`,
+		},
+	}, env)
+	return "c-" + name
+}
+
+func TestInspectMapsPodContainer(t *testing.T) {
+	runtime := NewFakeRuntime()
+	source := newTestSource(t, runtime, 0)
+	id := addPod(runtime, "web", []string{"HOSTNAME=web-0", "SERVICE_NAME=web"})
+
+	container, err := source.Inspect(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if container.ID != id || container.Name != "web" || !container.Kubernetes() || container.PodName() != "default/web" {
+		t.Fatalf("container = %+v", container)
+	}
+	if got := container.SandBoxMetadata.Metadata; got.ID != "sandbox-web" || got.IP != "10.0.0.2" || !reflect.DeepEqual(got.AdditionalIPs, []string{"fd00::2"}) {
+		t.Fatalf("sandbox metadata = %+v", got)
+	}
+	ports, err := container.ContainerMetadata.GetPortMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []ctrclient.PortMapping{{Name: "http", ContainerPort: 8080, Protocol: "TCP"}}; !reflect.DeepEqual(ports, want) {
+		t.Fatalf("ports = %+v, want %+v", ports, want)
+	}
+	// the environment of the runtime spec is copied into the container config
+	if got := container.ContainerSpec.GetEnv("SERVICE_NAME"); got != "web" {
+		t.Fatalf("SERVICE_NAME = %q", got)
+	}
+	want := []ctrclient.EnvMetadata{{Key: "HOSTNAME", Value: "web-0"}, {Key: "SERVICE_NAME", Value: "web"}}
+	if got := container.ContainerMetadata.Metadata.Config.Envs; !reflect.DeepEqual(got, want) {
+		t.Fatalf("envs = %+v, want %+v", got, want)
+	}
+	if got := container.ContainerMetadata.Metadata.Config.HostName; got != "web-0" {
+		t.Fatalf("hostname = %q", got)
+	}
+}
+
+func TestInspectFallsBackToTheSandboxIPWithoutCNIResults(t *testing.T) {
+	runtime := NewFakeRuntime()
+	source := newTestSource(t, runtime, 0)
+	id := addPod(runtime, "web", nil)
+	// a cache entry that cannot be read
+	if err := os.Mkdir(filepath.Join(source.CNIResultsDir, "bridge-sandbox-web-eth0"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	container, err := source.Inspect(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if container.Networks != nil || container.SandBoxMetadata.Metadata.IP != "10.0.0.2" {
+		t.Fatalf("networks = %v, ip = %q", container.Networks, container.SandBoxMetadata.Metadata.IP)
+	}
+}
+
+func TestInspectSkipsContainersOutsidePods(t *testing.T) {
+	runtime := NewFakeRuntime()
+	source := newTestSource(t, runtime, 0)
+	runtime.AddContainer(&runtimeapi.Container{
+		Id:       "plain",
+		Metadata: &runtimeapi.ContainerMetadata{Name: "plain"},
+		State:    runtimeapi.ContainerState_CONTAINER_RUNNING,
+	}, nil)
+
+	for _, id := range []string{"plain", "missing"} {
+		container, err := source.Inspect(context.Background(), id)
+		if err != nil || container != nil {
+			t.Fatalf("Inspect(%s) = %+v, %v", id, container, err)
+		}
+	}
+}
+
+func TestListAndStatus(t *testing.T) {
+	runtime := NewFakeRuntime()
+	source := newTestSource(t, runtime, 0)
+	web := addPod(runtime, "web", nil)
+	db := addPod(runtime, "db", nil)
+	runtime.SetState(db, runtimeapi.ContainerState_CONTAINER_EXITED)
+
+	ids, err := source.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{db, web}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("ids = %q, want %q", ids, want)
+	}
+
+	for id, want := range map[string]bridge.ContainerState{web: bridge.StateRunning, db: bridge.StateStopped} {
+		state, err := source.Status(context.Background(), id)
+		if err != nil || state != want {
+			t.Fatalf("Status(%s) = %v, %v, want %v", id, state, err, want)
+		}
+	}
+	if _, err := source.Status(context.Background(), "missing"); !errdefs.IsNotFound(err) {
+		t.Fatalf("err = %v, want not found", err)
+	}
+
+	version, err := source.Version(context.Background())
+	if err != nil || version != "fake 0.1.0" {
+		t.Fatalf("version = %q, %v", version, err)
+	}
+}
+
+func receive(t *testing.T, events <-chan *bridge.ContainerEvent) *bridge.ContainerEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+	return nil
+}
+
+func TestEventsStreamsContainerEvents(t *testing.T) {
+	runtime := NewFakeRuntime()
+	source := newTestSource(t, runtime, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, _ := source.Events(ctx)
+	go runtime.Emit(&runtimeapi.ContainerEventResponse{
+		ContainerId:        "c-web",
+		ContainerEventType: runtimeapi.ContainerEventType_CONTAINER_STARTED_EVENT,
+	})
+
+	event := receive(t, events)
+	if event.Type != bridge.EventStart || event.ContainerID != "c-web" {
+		t.Fatalf("event = %+v", event)
+	}
+}
+
+func TestEventsPollWithoutEventStream(t *testing.T) {
+	runtime := NewFakeRuntime()
+	runtime.NoEvents = true
+	source := newTestSource(t, runtime, 20*time.Millisecond)
+	web := addPod(runtime, "web", nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, _ := source.Events(ctx)
+	// wait for the first listing before the containers change
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.Lists() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	db := addPod(runtime, "db", nil)
+	runtime.SetState(web, runtimeapi.ContainerState_CONTAINER_EXITED)
+
+	got := map[string]bridge.EventType{}
+	for len(got) < 2 {
+		event := receive(t, events)
+		got[event.ContainerID] = event.Type
+	}
+	if want := map[string]bridge.EventType{db: bridge.EventStart, web: bridge.EventDelete}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+}
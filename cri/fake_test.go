@@ -0,0 +1,208 @@
+package cri
+
+import (
+	"context"
+	"encoding/json"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+	"net"
+	"os"
+	"registrator-containerd/pkg/ctrclient"
+	"sort"
+	"sync"
+)
+
+// FakeRuntime is an in-memory CRI runtime service that can be served on a
+// unix socket, so that Source can be exercised without containerd or CRI-O.
+type FakeRuntime struct {
+	runtimeapi.UnimplementedRuntimeServiceServer
+
+	mu         sync.Mutex
+	containers map[string]*fakeContainer
+	sandboxes  map[string]*runtimeapi.PodSandboxStatus
+	events     chan *runtimeapi.ContainerEventResponse
+	server     *grpc.Server
+	lists      int
+
+	// NoEvents makes GetContainerEvents return Unimplemented like runtimes
+	// without evented PLEG support.
+	NoEvents bool
+}
+
+type fakeContainer struct {
+	container *runtimeapi.Container
+	env       []string
+}
+
+func NewFakeRuntime() *FakeRuntime {
+	return &FakeRuntime{
+		containers: make(map[string]*fakeContainer),
+		sandboxes:  make(map[string]*runtimeapi.PodSandboxStatus),
+		events:     make(chan *runtimeapi.ContainerEventResponse),
+	}
+}
+
+// Serve listens on the unix socket and serves the runtime service in the
+// background until Stop is called.
+func (f *FakeRuntime) Serve(socket string) error {
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	f.server = grpc.NewServer()
+	runtimeapi.RegisterRuntimeServiceServer(f.server, f)
+	go f.server.Serve(listener)
+	return nil
+}
+
+func (f *FakeRuntime) Stop() {
+	if f.server != nil {
+		f.server.Stop()
+	}
+}
+
+// AddSandbox adds or replaces a pod sandbox.
+func (f *FakeRuntime) AddSandbox(sandbox *runtimeapi.PodSandboxStatus) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sandboxes[sandbox.Id] = sandbox
+}
+
+// AddContainer adds or replaces a container with the environment reported
+// in its verbose status.
+func (f *FakeRuntime) AddContainer(container *runtimeapi.Container, env []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.containers[container.Id] = &fakeContainer{container: container, env: env}
+}
+
+func (f *FakeRuntime) SetState(containerId string, state runtimeapi.ContainerState) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c := f.containers[containerId]; c != nil {
+		// copied, a listing may still be marshalling the old one
+		container := *c.container
+		container.State = state
+		c.container = &container
+	}
+}
+
+func (f *FakeRuntime) DeleteContainer(containerId string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.containers, containerId)
+}
+
+// Emit sends an event to the GetContainerEvents stream, it blocks until a
+// client receives it.
+func (f *FakeRuntime) Emit(event *runtimeapi.ContainerEventResponse) {
+	f.events <- event
+}
+
+// Lists returns how many times the containers were listed.
+func (f *FakeRuntime) Lists() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lists
+}
+
+func (f *FakeRuntime) Version(ctx context.Context, request *runtimeapi.VersionRequest) (*runtimeapi.VersionResponse, error) {
+	return &runtimeapi.VersionResponse{
+		Version:           "0.1.0",
+		RuntimeName:       "fake",
+		RuntimeVersion:    "0.1.0",
+		RuntimeApiVersion: "v1",
+	}, nil
+}
+
+func (f *FakeRuntime) ListContainers(ctx context.Context, request *runtimeapi.ListContainersRequest) (*runtimeapi.ListContainersResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lists++
+
+	filter := request.GetFilter()
+	response := &runtimeapi.ListContainersResponse{}
+	for _, c := range f.containers {
+		if filter.GetId() != "" && filter.GetId() != c.container.Id {
+			continue
+		}
+		if filter.GetPodSandboxId() != "" && filter.GetPodSandboxId() != c.container.PodSandboxId {
+			continue
+		}
+		if filter.GetState() != nil && filter.GetState().State != c.container.State {
+			continue
+		}
+		response.Containers = append(response.Containers, c.container)
+	}
+	sort.Slice(response.Containers, func(i, j int) bool {
+		return response.Containers[i].Id < response.Containers[j].Id
+	})
+	return response, nil
+}
+
+func (f *FakeRuntime) ContainerStatus(ctx context.Context, request *runtimeapi.ContainerStatusRequest) (*runtimeapi.ContainerStatusResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c := f.containers[request.ContainerId]
+	if c == nil {
+		return nil, status.Errorf(codes.NotFound, "container %q not found", request.ContainerId)
+	}
+	response := &runtimeapi.ContainerStatusResponse{
+		Status: &runtimeapi.ContainerStatus{
+			Id:          c.container.Id,
+			Metadata:    c.container.Metadata,
+			State:       c.container.State,
+			CreatedAt:   c.container.CreatedAt,
+			Image:       c.container.Image,
+			ImageRef:    c.container.ImageRef,
+			Labels:      c.container.Labels,
+			Annotations: c.container.Annotations,
+		},
+	}
+	if request.Verbose {
+		var spec ctrclient.ContainerSpec
+		spec.Process.Env = c.env
+		info, err := json.Marshal(map[string]any{
+			"sandboxID":   c.container.PodSandboxId,
+			"runtimeSpec": spec,
+		})
+		if err != nil {
+			return nil, err
+		}
+		response.Info = map[string]string{"info": string(info)}
+	}
+	return response, nil
+}
+
+func (f *FakeRuntime) PodSandboxStatus(ctx context.Context, request *runtimeapi.PodSandboxStatusRequest) (*runtimeapi.PodSandboxStatusResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sandbox := f.sandboxes[request.PodSandboxId]
+	if sandbox == nil {
+		return nil, status.Errorf(codes.NotFound, "sandbox %q not found", request.PodSandboxId)
+	}
+	return &runtimeapi.PodSandboxStatusResponse{Status: sandbox}, nil
+}
+
+func (f *FakeRuntime) GetContainerEvents(request *runtimeapi.GetEventsRequest, stream runtimeapi.RuntimeService_GetContainerEventsServer) error {
+	if f.NoEvents {
+		return status.Error(codes.Unimplemented, "GetContainerEvents is not implemented")
+	}
+	for {
+		select {
+		case event := <-f.events:
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package httpcollector
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment variables configuring the security of the collector
+// connection, like CONSUL_CACERT and friends for consul-tls.
+const (
+	EnvCACert      = "HTTPCOLLECTOR_CACERT"
+	EnvClientCert  = "HTTPCOLLECTOR_CLIENT_CERT"
+	EnvClientKey   = "HTTPCOLLECTOR_CLIENT_KEY"
+	EnvTokenFile   = "HTTPCOLLECTOR_TOKEN_FILE"
+	EnvHMACKeyFile = "HTTPCOLLECTOR_HMAC_KEY_FILE"
+)
+
+// Headers of signed requests. The signature is the hex encoded
+// HMAC-SHA256 of "<method>\n<path and query>\n<timestamp>\n<body>" with
+// the key of EnvHMACKeyFile, prefixed with "sha256=".
+const (
+	TimestampHeader = "X-Registrator-Timestamp"
+	SignatureHeader = "X-Registrator-Signature"
+)
+
+// tlsConfig returns the TLS configuration of httpcollectors:// from the CA
+// bundle and client certificate in the environment.
+func tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile := os.Getenv(EnvCACert); caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate in %s", caFile)
+		}
+	}
+
+	certFile, keyFile := os.Getenv(EnvClientCert), os.Getenv(EnvClientKey)
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("%s and %s must be set together", EnvClientCert, EnvClientKey)
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// watchedFile is the trimmed content of a file, read again when the file
+// changes, e.g. a rotated token.
+type watchedFile struct {
+	path    string
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	content []byte
+}
+
+func (f *watchedFile) read() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+	if f.content != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.content, nil
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	content := bytes.TrimSpace(data)
+	if len(content) == 0 {
+		return nil, fmt.Errorf("%s is empty", f.path)
+	}
+	f.content, f.modTime, f.size = content, info.ModTime(), info.Size()
+	return f.content, nil
+}
+
+// authTransport adds the bearer token and the signature to every request.
+type authTransport struct {
+	base    http.RoundTripper
+	token   *watchedFile
+	hmacKey *watchedFile
+}
+
+func (t *authTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	request = request.Clone(request.Context())
+
+	if t.token != nil {
+		token, err := t.token.read()
+		if err != nil {
+			return nil, fmt.Errorf("read token: %w", err)
+		}
+		request.Header.Set("Authorization", "Bearer "+string(token))
+	}
+
+	if t.hmacKey != nil {
+		key, err := t.hmacKey.read()
+		if err != nil {
+			return nil, fmt.Errorf("read hmac key: %w", err)
+		}
+		var body []byte
+		if request.Body != nil {
+			if request.GetBody == nil {
+				return nil, errors.New("cannot sign a request body that cannot be read twice")
+			}
+			reader, err := request.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			body, err = io.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		request.Header.Set(TimestampHeader, timestamp)
+		request.Header.Set(SignatureHeader, "sha256="+Sign(key, request.Method, request.URL.RequestURI(), timestamp, body))
+	}
+
+	return t.base.RoundTrip(request)
+}
+
+// Sign returns the hex encoded signature of a request, collectors use it to
+// verify SignatureHeader.
+func Sign(key []byte, method string, requestURI string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join([]string{method, requestURI, timestamp, ""}, "\n")))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newClient returns the client of the collector, with TLS for
+// httpcollectors:// and the authentication configured in the environment.
+// Requests are bounded by the context of the operation, -adapter-timeout.
+func newClient(secure bool) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if secure {
+		config, err := tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = config
+	}
+
+	auth := &authTransport{base: transport}
+	if path := os.Getenv(EnvTokenFile); path != "" {
+		auth.token = &watchedFile{path: path}
+		if _, err := auth.token.read(); err != nil {
+			return nil, err
+		}
+		if !secure {
+			logger.WithField("file", path).Warn("sending the bearer token in cleartext, use httpcollectors://")
+		}
+	}
+	if path := os.Getenv(EnvHMACKeyFile); path != "" {
+		auth.hmacKey = &watchedFile{path: path}
+		if _, err := auth.hmacKey.read(); err != nil {
+			return nil, err
+		}
+	}
+
+	var roundTripper http.RoundTripper = transport
+	if auth.token != nil || auth.hmacKey != nil {
+		roundTripper = auth
+	}
+	return &http.Client{Transport: roundTripper}, nil
+}
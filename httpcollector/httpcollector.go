@@ -2,50 +2,105 @@ package httpcollector
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"registrator-containerd/bridge"
-	"time"
+	"registrator-containerd/utils"
+	"sync/atomic"
 )
 
+var logger = utils.L.WithField("adapter", "httpcollector")
+
+// codeUnknownAgent is the code doping answers for an agent the collector has
+// no record of.
+const codeUnknownAgent = 404
+
 func init() {
 	f := new(Factory)
 	bridge.Register(f, "httpcollector")
+	bridge.Register(f, "httpcollectors")
 }
 
 type Factory struct {
 }
 
 func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
-	collectorAdapter := &HttpcollectorAdapter{client: &http.Client{Timeout: 10 * time.Second}, baseUrl: "http://" + uri.Host}
+	return bridge.AdapterV1(f.NewV2(uri))
+}
+
+func (f *Factory) NewV2(uri *url.URL) bridge.RegistryAdapterV2 {
+	secure := uri.Scheme == "httpcollectors"
+	client, err := newClient(secure)
+	if err != nil {
+		logger.WithError(err).WithField("scheme", uri.Scheme).Fatal("cannot create collector client")
+	}
+	baseUrl := "http://" + uri.Host
+	if secure {
+		baseUrl = "https://" + uri.Host
+	}
+	collectorAdapter := &HttpcollectorAdapter{client: client, baseUrl: baseUrl, noBatch: new(atomic.Bool)}
 	return collectorAdapter
 }
 
 type HttpcollectorAdapter struct {
 	client  *http.Client
 	baseUrl string
+	// noBatch is set once the collector answered that it has no batch API
+	noBatch *atomic.Bool
 }
 
-func (h HttpcollectorAdapter) RegisterAgentNode(dataCenterId string, hostIp string) (string, error) {
-	agentRegister := AgentRegister{DataCenter: dataCenterId, HostName: hostIp, Ip: hostIp}
+func (h HttpcollectorAdapter) post(ctx context.Context, url string, data []byte) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	return h.client.Do(request)
+}
+
+func (h HttpcollectorAdapter) get(ctx context.Context, url string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return h.client.Do(request)
+}
+
+// Capabilities: the collector does not expire services, it keeps a record
+// of the agent.
+func (h HttpcollectorAdapter) Capabilities() bridge.Capabilities {
+	return bridge.Capabilities{Batch: true, Agent: true}
+}
+
+func (h HttpcollectorAdapter) RegisterAgentNode(ctx context.Context, agent bridge.Agent) (string, error) {
+	agentRegister := AgentRegister{
+		DataCenter: agent.DataCenterId,
+		HostName:   agent.HostIp,
+		Ip:         agent.HostIp,
+		NodeName:   agent.Hostname,
+		Version:    agent.Version,
+		Runtime:    agent.Runtime,
+		Containers: agent.Containers,
+	}
 	postData, err := json.Marshal(agentRegister)
 	if err != nil {
 		return "", err
 	}
 
-	log.Println("RegisterAgentNode : " + string(postData))
+	logger.WithField("payload", string(postData)).Info("register agent node")
 
 	var url = h.baseUrl + "/api/agentnode/register"
-	response, err := h.client.Post(url, "application/json", bytes.NewReader(postData))
+	response, err := h.post(ctx, url, postData)
 	if err != nil {
 		return "", err
 	}
 	if response.StatusCode != 200 {
-		return "", errors.New("RegisterAgentNode response status " + response.Status)
+		return "", statusError("RegisterAgentNode", response)
 	}
 
 	defer response.Body.Close()
@@ -58,24 +113,24 @@ func (h HttpcollectorAdapter) RegisterAgentNode(dataCenterId string, hostIp stri
 	apiResponse := new(AgentRegisterResponse)
 	err = json.Unmarshal(body, apiResponse)
 	if err != nil {
-		return "", errors.New("RegisterAgentNode response：" + string(body))
+		return "", decodeError("RegisterAgentNode", err)
 	}
 
 	if apiResponse.Code != 0 {
-		return "", errors.New("RegisterAgentNode response：" + string(body))
+		return "", rejectedError("RegisterAgentNode", apiResponse.Code, apiResponse.Message)
 	}
 
 	return apiResponse.Data.Id, nil
 }
 
-func (h HttpcollectorAdapter) Ping(agentId string) error {
+func (h HttpcollectorAdapter) Ping(ctx context.Context, agentId string) error {
 	var url = h.baseUrl + "/api/agentnode/doping?id=" + agentId
-	response, err := h.client.Get(url)
+	response, err := h.get(ctx, url)
 	if err != nil {
 		return err
 	}
 	if response.StatusCode != 200 {
-		return errors.New("Ping response status " + response.Status)
+		return statusError("Ping", response)
 	}
 
 	defer response.Body.Close()
@@ -88,31 +143,34 @@ func (h HttpcollectorAdapter) Ping(agentId string) error {
 	apiResponse := new(DoPingResponse)
 	err = json.Unmarshal(body, apiResponse)
 	if err != nil {
-		return errors.New("Ping response " + string(body))
+		return decodeError("Ping", err)
 	}
 
+	if apiResponse.Code == codeUnknownAgent {
+		return bridge.ErrUnknownAgent
+	}
 	if apiResponse.Code != 0 {
-		return errors.New("Ping response " + string(body))
+		return rejectedError("Ping", apiResponse.Code, apiResponse.Message)
 	}
 
 	return nil
 }
 
-func (h HttpcollectorAdapter) Register(service *bridge.Service) error {
+func (h HttpcollectorAdapter) Register(ctx context.Context, service *bridge.Service) error {
 	postData, err := json.Marshal(service)
 	if err != nil {
 		return err
 	}
 
-	log.Println("Register : " + string(postData))
+	logger.WithField("service", service.ID).WithField("payload", service.RedactedJSON()).Debug("register")
 
 	var url = h.baseUrl + "/api/serviceinstancereg/containerregister"
-	response, err := h.client.Post(url, "application/json", bytes.NewReader(postData))
+	response, err := h.post(ctx, url, postData)
 	if err != nil {
 		return err
 	}
 	if response.StatusCode != 200 {
-		return errors.New("Register response status " + response.Status)
+		return statusError("Register", response)
 	}
 
 	defer response.Body.Close()
@@ -125,32 +183,38 @@ func (h HttpcollectorAdapter) Register(service *bridge.Service) error {
 	apiResponse := new(ReregisterResponse)
 	err = json.Unmarshal(body, apiResponse)
 	if err != nil {
-		return errors.New("Register response " + string(body))
+		return decodeError("Register", err)
 	}
 
 	if apiResponse.Code != 0 {
-		return errors.New("Register response " + string(body))
+		return rejectedError("Register", apiResponse.Code, apiResponse.Message)
 	}
 
 	return nil
 }
 
-func (h HttpcollectorAdapter) Deregister(service *bridge.Service) error {
+// Update registers the service again, the collector replaces the instance
+// with the same ID.
+func (h HttpcollectorAdapter) Update(ctx context.Context, service *bridge.Service) error {
+	return h.Register(ctx, service)
+}
+
+func (h HttpcollectorAdapter) Deregister(ctx context.Context, service *bridge.Service) error {
 	postData, err := json.Marshal(service)
 
 	if err != nil {
 		return err
 	}
 
-	log.Println("Deregister : " + string(postData))
+	logger.WithField("service", service.ID).WithField("payload", service.RedactedJSON()).Debug("deregister")
 
 	var url = h.baseUrl + "/api/serviceinstancereg/containerderegister"
-	response, err := h.client.Post(url, "application/json", bytes.NewReader(postData))
+	response, err := h.post(ctx, url, postData)
 	if err != nil {
 		return err
 	}
 	if response.StatusCode != 200 {
-		return errors.New("Deregister response status " + response.Status)
+		return statusError("Deregister", response)
 	}
 
 	defer response.Body.Close()
@@ -163,28 +227,135 @@ func (h HttpcollectorAdapter) Deregister(service *bridge.Service) error {
 	apiResponse := new(ReregisterResponse)
 	err = json.Unmarshal(body, apiResponse)
 	if err != nil {
-		return errors.New("Deregister response " + string(body))
+		return decodeError("Deregister", err)
 	}
 
 	if apiResponse.Code != 0 {
-		return errors.New("Deregister response" + string(body))
+		return rejectedError("Deregister", apiResponse.Code, apiResponse.Message)
 	}
 
 	return nil
 }
 
-func (h HttpcollectorAdapter) Refresh(service *bridge.Service) error {
+// statusError returns the error of a response that is not 200 OK, the
+// collector refused requests it answered with a client error.
+func statusError(op string, response *http.Response) error {
+	if response.StatusCode >= 400 && response.StatusCode < 500 {
+		return fmt.Errorf("%s response status %s: %w", op, response.Status, bridge.ErrRejected)
+	}
+	return errors.New(op + " response status " + response.Status)
+}
+
+// decodeError is returned for a response that is not JSON. The body is left
+// out, it may echo the payload.
+func decodeError(op string, err error) error {
+	return fmt.Errorf("%s response: %w", op, err)
+}
+
+// rejectedError is returned for a response with a code other than 0.
+func rejectedError(op string, code int, message string) error {
+	return fmt.Errorf("%s response code %d: %s: %w", op, code, bridge.Redact(message), bridge.ErrRejected)
+}
+
+// RegisterBatch registers services with one POST of containerregisterbatch,
+// or one POST per service when the collector does not support it.
+func (h HttpcollectorAdapter) RegisterBatch(ctx context.Context, services []*bridge.Service) error {
+	return h.batch(ctx, "/api/serviceinstancereg/containerregisterbatch", services, h.Register)
+}
+
+// DeregisterBatch deregisters services with one POST of
+// containerderegisterbatch, or one POST per service when the collector does
+// not support it.
+func (h HttpcollectorAdapter) DeregisterBatch(ctx context.Context, services []*bridge.Service) error {
+	return h.batch(ctx, "/api/serviceinstancereg/containerderegisterbatch", services, h.Deregister)
+}
+
+func (h HttpcollectorAdapter) batch(ctx context.Context, path string, services []*bridge.Service, single func(context.Context, *bridge.Service) error) error {
+	if !h.noBatch.Load() {
+		err := h.postBatch(ctx, path, services)
+		if err != errNoBatch {
+			return err
+		}
+		logger.WithField("path", path).Warn("collector has no batch API, sending services one by one")
+		h.noBatch.Store(true)
+	}
+
+	failed := make(map[string]error)
+	for _, service := range services {
+		if err := single(ctx, service); err != nil {
+			failed[service.ID] = err
+		}
+	}
+	if len(failed) > 0 {
+		return &bridge.BatchError{Errors: failed}
+	}
 	return nil
 }
 
-func (h HttpcollectorAdapter) Services(agentId string) ([]*bridge.Service, error) {
+// errNoBatch is returned by postBatch when the collector does not know the
+// batch endpoint.
+var errNoBatch = errors.New("batch API not supported")
+
+func (h HttpcollectorAdapter) postBatch(ctx context.Context, path string, services []*bridge.Service) error {
+	postData, err := json.Marshal(services)
+	if err != nil {
+		return err
+	}
+
+	logger.WithField("path", path).WithField("services", len(services)).Debug("batch")
+
+	response, err := h.post(ctx, h.baseUrl+path, postData)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return errNoBatch
+	default:
+		return statusError("batch", response)
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	apiResponse := new(BatchResponse)
+	err = json.Unmarshal(body, apiResponse)
+	if err != nil {
+		return decodeError("batch", err)
+	}
+
+	if apiResponse.Code != 0 {
+		return rejectedError("batch", apiResponse.Code, apiResponse.Message)
+	}
+
+	failed := make(map[string]error)
+	for _, result := range apiResponse.Data {
+		if result.Code != 0 {
+			failed[result.ID] = rejectedError("batch", result.Code, result.Message)
+		}
+	}
+	if len(failed) > 0 {
+		return &bridge.BatchError{Errors: failed}
+	}
+	return nil
+}
+
+func (h HttpcollectorAdapter) Refresh(ctx context.Context, service *bridge.Service) error {
+	return nil
+}
+
+func (h HttpcollectorAdapter) Services(ctx context.Context, agentId string) ([]*bridge.Service, error) {
 	var url = h.baseUrl + "/api/serviceinstancereg/containerservicelist?agentId=" + agentId
-	response, err := h.client.Get(url)
+	response, err := h.get(ctx, url)
 	if err != nil {
 		return nil, err
 	}
 	if response.StatusCode != 200 {
-		return nil, errors.New("Services response status " + response.Status)
+		return nil, statusError("Services", response)
 	}
 
 	defer response.Body.Close()
@@ -197,11 +368,11 @@ func (h HttpcollectorAdapter) Services(agentId string) ([]*bridge.Service, error
 	apiResponse := new(ApiServicesResponse)
 	err = json.Unmarshal(body, apiResponse)
 	if err != nil {
-		return nil, errors.New("Services response " + string(body))
+		return nil, decodeError("Services", err)
 	}
 
 	if apiResponse.Code != 0 {
-		return nil, errors.New("Services response " + string(body))
+		return nil, rejectedError("Services", apiResponse.Code, apiResponse.Message)
 	}
 
 	out := make([]*bridge.Service, len(apiResponse.Data))
@@ -209,11 +380,15 @@ func (h HttpcollectorAdapter) Services(agentId string) ([]*bridge.Service, error
 
 	for _, v := range apiResponse.Data {
 		s := &bridge.Service{
-			ID:   v.ID,
-			Name: v.Name,
-			Port: v.Port,
-			Tags: v.Tags,
-			IP:   v.Ip,
+			ID:      v.ID,
+			Name:    v.Name,
+			Port:    v.Port,
+			Tags:    v.Tags,
+			IP:      v.Ip,
+			IPs:     v.IPs,
+			Attrs:   v.Attrs,
+			TTL:     v.TTL,
+			AgentId: v.AgentId,
 		}
 		out[i] = s
 		i++
@@ -227,13 +402,30 @@ type ReregisterResponse struct {
 	Message string
 }
 
+// BatchResponse 批量注册、注销请求响应，Data 为每个服务的结果
+type BatchResponse struct {
+	Code    int
+	Message string
+	Data    []*BatchResult
+}
+
+type BatchResult struct {
+	ID      string
+	Code    int
+	Message string
+}
+
 // ApiService 服务端返回的数据结构
 type ApiService struct {
-	ID   string
-	Name string
-	Port int
-	Tags []string
-	Ip   string
+	ID      string
+	Name    string
+	Port    int
+	Tags    []string
+	Ip      string
+	IPs     []string
+	Attrs   map[string]string
+	TTL     int
+	AgentId string
 }
 
 // ApiServicesResponse 服务列表请求响应
@@ -243,11 +435,16 @@ type ApiServicesResponse struct {
 	Data    []*ApiService
 }
 
+// AgentRegister HostName 为节点 IP，NodeName 为节点主机名
 type AgentRegister struct {
 	HostName   string
 	Ip         string
 	DataCenter string
 	Id         string
+	NodeName   string
+	Version    string
+	Runtime    string
+	Containers int
 }
 
 type AgentRegisterResponse struct {
@@ -0,0 +1,352 @@
+package httpcollector
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"registrator-containerd/bridge"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collector stands in for the collector, it records the request paths and
+// fails the services in reject with message.
+type collector struct {
+	mu      sync.Mutex
+	paths   []string
+	batch   bool
+	reject  map[string]bool
+	message string
+	unknown bool
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paths = append(c.paths, r.URL.Path)
+	body, _ := io.ReadAll(r.Body)
+
+	switch r.URL.Path {
+	case "/api/agentnode/doping":
+		if c.unknown {
+			w.Write([]byte(`{"Code":404,"Message":"unknown agent"}`))
+			return
+		}
+		w.Write([]byte(`{"Code":0}`))
+	case "/api/serviceinstancereg/containerregister", "/api/serviceinstancereg/containerderegister":
+		var service bridge.Service
+		json.Unmarshal(body, &service)
+		if c.reject[service.ID] {
+			json.NewEncoder(w).Encode(ReregisterResponse{Code: 1, Message: c.message})
+			return
+		}
+		w.Write([]byte(`{"Code":0}`))
+	case "/api/serviceinstancereg/containerregisterbatch", "/api/serviceinstancereg/containerderegisterbatch":
+		if !c.batch {
+			http.NotFound(w, r)
+			return
+		}
+		var services []*bridge.Service
+		json.Unmarshal(body, &services)
+		response := BatchResponse{}
+		for _, service := range services {
+			if c.reject[service.ID] {
+				response.Data = append(response.Data, &BatchResult{ID: service.ID, Code: 1, Message: "rejected"})
+			}
+		}
+		json.NewEncoder(w).Encode(response)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (c *collector) requests() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	paths := c.paths
+	c.paths = nil
+	return paths
+}
+
+func newTestAdapter(t *testing.T, c *collector) bridge.RegistryAdapterV2 {
+	t.Helper()
+	server := httptest.NewServer(c)
+	t.Cleanup(server.Close)
+	uri, err := url.Parse("httpcollector://" + server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return new(Factory).NewV2(uri)
+}
+
+func testServices() []*bridge.Service {
+	return []*bridge.Service{{ID: "node:a:80", Name: "a"}, {ID: "node:b:80", Name: "b"}}
+}
+
+func TestRegisterBatchReportsFailedServices(t *testing.T) {
+	c := &collector{batch: true, reject: map[string]bool{"node:b:80": true}}
+	adapter := newTestAdapter(t, c).(bridge.BatchAdapter)
+
+	err := adapter.RegisterBatch(context.Background(), testServices())
+
+	var failed *bridge.BatchError
+	if !errors.As(err, &failed) || len(failed.Errors) != 1 || failed.Errors["node:b:80"] == nil {
+		t.Fatalf("err = %v, want a batch error for node:b:80", err)
+	}
+	if got, want := c.requests(), []string{"/api/serviceinstancereg/containerregisterbatch"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("requests = %q, want %q", got, want)
+	}
+}
+
+func TestBatchFallsBackToSingleRequestsWithoutBatchAPI(t *testing.T) {
+	c := &collector{reject: map[string]bool{"node:a:80": true}}
+	adapter := newTestAdapter(t, c).(bridge.BatchAdapter)
+
+	err := adapter.RegisterBatch(context.Background(), testServices())
+
+	var failed *bridge.BatchError
+	if !errors.As(err, &failed) || len(failed.Errors) != 1 || failed.Errors["node:a:80"] == nil {
+		t.Fatalf("err = %v, want a batch error for node:a:80", err)
+	}
+	want := []string{
+		"/api/serviceinstancereg/containerregisterbatch",
+		"/api/serviceinstancereg/containerregister",
+		"/api/serviceinstancereg/containerregister",
+	}
+	if got := c.requests(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("requests = %q, want %q", got, want)
+	}
+
+	// the batch API is not tried again
+	if err := adapter.DeregisterBatch(context.Background(), testServices()[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.requests(), []string{"/api/serviceinstancereg/containerderegister"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("requests = %q, want %q", got, want)
+	}
+}
+
+func TestPingReportsUnknownAgent(t *testing.T) {
+	c := &collector{}
+	adapter := newTestAdapter(t, c)
+
+	if err := adapter.Ping(context.Background(), "agent"); err != nil {
+		t.Fatal(err)
+	}
+	c.mu.Lock()
+	c.unknown = true
+	c.mu.Unlock()
+	if err := adapter.Ping(context.Background(), "agent"); !errors.Is(err, bridge.ErrUnknownAgent) {
+		t.Fatalf("err = %v, want ErrUnknownAgent", err)
+	}
+}
+
+func TestRefusedRequestsAreRejected(t *testing.T) {
+	c := &collector{reject: map[string]bool{"node:a:80": true}}
+	adapter := newTestAdapter(t, c)
+
+	if err := adapter.Register(context.Background(), testServices()[0]); !errors.Is(err, bridge.ErrRejected) {
+		t.Fatalf("err = %v, want ErrRejected", err)
+	}
+	// client errors are refusals as well
+	if _, err := adapter.Services(context.Background(), "agent"); !errors.Is(err, bridge.ErrRejected) {
+		t.Fatalf("err = %v, want ErrRejected", err)
+	}
+}
+
+func TestRejectionsAreRedacted(t *testing.T) {
+	c := &collector{
+		reject:  map[string]bool{"node:a:80": true},
+		message: "bad check http://app/health?token=hunter2",
+	}
+	adapter := newTestAdapter(t, c)
+
+	err := adapter.Register(context.Background(), testServices()[0])
+	if err == nil {
+		t.Fatal("register succeeded")
+	}
+	if want := "Register response code 1: bad check http://app/health?token=***: operation rejected"; err.Error() != want {
+		t.Fatalf("err = %q, want %q", err, want)
+	}
+}
+
+func TestSignMatchesAKnownVector(t *testing.T) {
+	// python3: hmac.new(b"key", b"POST\n/api/agentnode/register?x=1\n1700000000\n" + body, hashlib.sha256)
+	got := Sign([]byte("key"), http.MethodPost, "/api/agentnode/register?x=1", "1700000000", []byte(`{"a":1}`))
+	if want := "8d9963bc9c613c0a75d95246d65b0a20dc0564dace66b4e69248cece20c0c9d5"; got != want {
+		t.Fatalf("signature = %s, want %s", got, want)
+	}
+}
+
+func TestRequestsAreSignedWithTheRotatedToken(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile, keyFile := filepath.Join(dir, "token"), filepath.Join(dir, "key")
+	write := func(path string, content string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	write(tokenFile, "token-1\n", now.Add(-time.Minute))
+	write(keyFile, "key", now)
+	t.Setenv(EnvTokenFile, tokenFile)
+	t.Setenv(EnvHMACKeyFile, keyFile)
+
+	type signed struct {
+		authorization string
+		verified      bool
+	}
+	requests := make(chan signed, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		signature := "sha256=" + Sign([]byte("key"), r.Method, r.URL.RequestURI(), r.Header.Get(TimestampHeader), body)
+		requests <- signed{r.Header.Get("Authorization"), r.Header.Get(SignatureHeader) == signature}
+		w.Write([]byte(`{"Code":0}`))
+	}))
+	t.Cleanup(server.Close)
+	uri, err := url.Parse("httpcollector://" + server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	adapter := new(Factory).NewV2(uri)
+
+	if err := adapter.Register(context.Background(), testServices()[0]); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-requests; got.authorization != "Bearer token-1" || !got.verified {
+		t.Fatalf("request = %+v", got)
+	}
+
+	// the token is rotated between requests
+	write(tokenFile, "token-2\n", now)
+	if err := adapter.Ping(context.Background(), "agent"); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-requests; got.authorization != "Bearer token-2" || !got.verified {
+		t.Fatalf("request = %+v", got)
+	}
+}
+
+// writeCert writes a certificate signed by parent, self-signed when parent
+// is nil, and its key to dir and returns them.
+func writeCert(t *testing.T, dir string, name string, template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), certPem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestMutualTLSFromTheEnvironment(t *testing.T) {
+	dir := t.TempDir()
+	ca := writeCert(t, dir, "ca", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	serverCert := writeCert(t, dir, "server", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "collector"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	writeCert(t, dir, "client", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "registrator"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+
+	clients := make(chan string, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clients <- r.TLS.PeerCertificates[0].Subject.CommonName
+		w.Write([]byte(`{"Code":0}`))
+	}))
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    roots,
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	t.Setenv(EnvCACert, filepath.Join(dir, "ca.pem"))
+	t.Setenv(EnvClientCert, filepath.Join(dir, "client.pem"))
+	t.Setenv(EnvClientKey, filepath.Join(dir, "client-key.pem"))
+	config, err := tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Certificates) != 1 || config.RootCAs == nil || config.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("tls config = %+v", config)
+	}
+
+	uri, err := url.Parse("httpcollectors://" + server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := new(Factory).NewV2(uri).Ping(context.Background(), "agent"); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-clients; got != "registrator" {
+		t.Fatalf("client certificate = %q", got)
+	}
+
+	// a certificate without its key is refused
+	t.Setenv(EnvClientKey, "")
+	if _, err := tlsConfig(); err == nil {
+		t.Fatal("tls config without a client key")
+	}
+}
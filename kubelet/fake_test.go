@@ -0,0 +1,70 @@
+package kubelet
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// FakeKubelet serves /pods like the kubelet, e.g. with httptest.NewServer,
+// so that the readiness gate can be exercised without a node.
+type FakeKubelet struct {
+	mu   sync.Mutex
+	pods map[string]Pod
+	// Token is the bearer token requests must carry when set.
+	Token string
+}
+
+func NewFakeKubelet() *FakeKubelet {
+	return &FakeKubelet{pods: make(map[string]Pod)}
+}
+
+// SetPod adds or replaces a pod with the given Ready condition.
+func (f *FakeKubelet) SetPod(uid string, namespace string, name string, ready bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var pod Pod
+	pod.Metadata.UID = uid
+	pod.Metadata.Name = name
+	pod.Metadata.Namespace = namespace
+	status := "False"
+	if ready {
+		status = "True"
+	}
+	pod.Status.Conditions = []PodCondition{{Type: "Ready", Status: status}}
+	f.pods[uid] = pod
+}
+
+func (f *FakeKubelet) DeletePod(uid string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.pods, uid)
+}
+
+func (f *FakeKubelet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/pods" {
+		http.NotFound(w, r)
+		return
+	}
+	if f.Token != "" && r.Header.Get("Authorization") != "Bearer "+f.Token {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	f.mu.Lock()
+	pods := podList{Items: make([]Pod, 0, len(f.pods))}
+	for _, pod := range f.pods {
+		pods.Items = append(pods.Items, pod)
+	}
+	f.mu.Unlock()
+	sort.Slice(pods.Items, func(i, j int) bool { return pods.Items[i].Metadata.UID < pods.Items[j].Metadata.UID })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Kind       string `json:"kind"`
+		APIVersion string `json:"apiVersion"`
+		Items      []Pod  `json:"items"`
+	}{"PodList", "v1", pods.Items})
+}
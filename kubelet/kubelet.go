@@ -0,0 +1,188 @@
+package kubelet
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"registrator-containerd/utils"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ReadOnlyEndpoint is the deprecated unauthenticated kubelet port.
+	ReadOnlyEndpoint = "http://127.0.0.1:10255"
+	// SecureEndpoint needs a bearer token that may get nodes/proxy.
+	SecureEndpoint = "https://127.0.0.1:10250"
+
+	DefaultTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+var logger = utils.L.WithField("component", "kubelet")
+
+// Pod is the part of a pod returned by the kubelet the readiness gate uses.
+type Pod struct {
+	Metadata struct {
+		UID       string `json:"uid"`
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Status struct {
+		Conditions []PodCondition `json:"conditions"`
+	} `json:"status"`
+}
+
+type PodCondition struct {
+	Type   string `json:"type"`
+	Status string `json:"status"`
+}
+
+// Ready reports whether the Ready condition of the pod is true.
+func (p *Pod) Ready() bool {
+	for _, condition := range p.Status.Conditions {
+		if condition.Type == "Ready" {
+			return condition.Status == "True"
+		}
+	}
+	return false
+}
+
+type podList struct {
+	Items []Pod `json:"items"`
+}
+
+// Client reads the pods of the node from the kubelet /pods endpoint.
+type Client struct {
+	endpoint  string
+	tokenFile string
+	client    *http.Client
+}
+
+// NewClient creates a client for the kubelet at endpoint. The token file is
+// read before every request so that rotated service account tokens are
+// picked up, it is not used when empty. The kubelet serving certificate is
+// verified against caFile, or the system roots when caFile is empty.
+func NewClient(endpoint string, tokenFile string, caFile string, insecureSkipVerify bool) (*Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	if caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &Client{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		tokenFile: tokenFile,
+		client:    &http.Client{Transport: transport, Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (c *Client) Pods(ctx context.Context) ([]Pod, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint+"/pods", nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.tokenFile != "" {
+		token, err := os.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get %s/pods: %s", c.endpoint, response.Status)
+	}
+
+	var pods podList
+	if err := json.NewDecoder(response.Body).Decode(&pods); err != nil {
+		return nil, errors.Join(fmt.Errorf("decode %s/pods failed", c.endpoint), err)
+	}
+	return pods.Items, nil
+}
+
+// Readiness tracks the Ready condition of the pods of the node, it
+// implements bridge.ReadinessGate. Pods the kubelet has not reported yet are
+// not ready.
+type Readiness struct {
+	client *Client
+	mu     sync.RWMutex
+	ready  map[string]bool
+}
+
+func NewReadiness(client *Client) *Readiness {
+	return &Readiness{client: client, ready: make(map[string]bool)}
+}
+
+func (r *Readiness) PodReady(podUid string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.ready[podUid]
+}
+
+// Poll reads the pods once and reports whether the readiness of any pod
+// changed. The last known readiness is kept when the kubelet cannot be
+// reached.
+func (r *Readiness) Poll(ctx context.Context) (bool, error) {
+	pods, err := r.client.Pods(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	ready := make(map[string]bool, len(pods))
+	for i := range pods {
+		if pods[i].Ready() {
+			ready[pods[i].Metadata.UID] = true
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changed := len(ready) != len(r.ready)
+	for uid := range ready {
+		if !r.ready[uid] {
+			changed = true
+		}
+	}
+	r.ready = ready
+	return changed, nil
+}
+
+// Run polls the kubelet every interval until ctx is done and calls
+// onChange after every poll that changed the readiness of a pod.
+func (r *Readiness) Run(ctx context.Context, interval time.Duration, onChange func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		changed, err := r.Poll(ctx)
+		if err != nil {
+			logger.WithError(err).Warn("poll pods failed")
+		} else if changed {
+			onChange()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
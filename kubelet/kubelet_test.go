@@ -0,0 +1,78 @@
+package kubelet
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestReadiness(t *testing.T, kubelet *FakeKubelet, tokenFile string) *Readiness {
+	t.Helper()
+	server := httptest.NewServer(kubelet)
+	t.Cleanup(server.Close)
+	client, err := NewClient(server.URL, tokenFile, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewReadiness(client)
+}
+
+func poll(t *testing.T, readiness *Readiness) bool {
+	t.Helper()
+	changed, err := readiness.Poll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return changed
+}
+
+func TestPollTracksPodReadiness(t *testing.T) {
+	kubelet := NewFakeKubelet()
+	readiness := newTestReadiness(t, kubelet, "")
+	kubelet.SetPod("uid-web", "default", "web", false)
+
+	if poll(t, readiness) || readiness.PodReady("uid-web") {
+		t.Fatal("pod that is not ready reported as ready")
+	}
+
+	kubelet.SetPod("uid-web", "default", "web", true)
+	if !poll(t, readiness) || !readiness.PodReady("uid-web") {
+		t.Fatal("ready pod not reported as ready")
+	}
+	if poll(t, readiness) {
+		t.Fatal("unchanged readiness reported as changed")
+	}
+
+	kubelet.DeletePod("uid-web")
+	if !poll(t, readiness) || readiness.PodReady("uid-web") {
+		t.Fatal("deleted pod still reported as ready")
+	}
+}
+
+func TestPollKeepsReadinessWhenKubeletFails(t *testing.T) {
+	kubelet := NewFakeKubelet()
+	kubelet.Token = "secret"
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	readiness := newTestReadiness(t, kubelet, tokenFile)
+	kubelet.SetPod("uid-web", "default", "web", true)
+
+	if !poll(t, readiness) || !readiness.PodReady("uid-web") {
+		t.Fatal("ready pod not reported as ready")
+	}
+
+	// the token file is read again before every request
+	if err := os.WriteFile(tokenFile, []byte("rotated\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readiness.Poll(context.Background()); err == nil {
+		t.Fatal("poll with a wrong token succeeded")
+	}
+	if !readiness.PodReady("uid-web") {
+		t.Fatal("last known readiness was dropped")
+	}
+}
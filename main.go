@@ -3,18 +3,22 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
-	events2 "github.com/containerd/containerd/api/events"
-	"github.com/containerd/containerd/events"
-	"github.com/containerd/typeurl/v2"
+	"github.com/cenkalti/backoff"
+	"github.com/containerd/containerd/namespaces"
 	"github.com/gliderlabs/pkg/usage"
-	"log"
 	"os"
+	"os/signal"
+	"registrator-containerd/admin"
 	"registrator-containerd/bridge"
+	"registrator-containerd/cri"
+	"registrator-containerd/kubelet"
 	"registrator-containerd/pkg/ctrclient"
+	"registrator-containerd/pkg/metrics"
+	"registrator-containerd/utils"
 	"strings"
+	"syscall"
 	"time"
 	// Register grpc event types
 	_ "github.com/containerd/containerd/api/events"
@@ -27,6 +31,7 @@ var versionChecker = usage.NewChecker("registrator", Version)
 var hostIp = flag.String("ip", "", "IP for ports mapped to the host")
 var internal = flag.Bool("internal", false, "Use internal ports instead of published ones")
 var explicit = flag.Bool("explicit", false, "Only register containers which have SERVICE_NAME label set")
+var ipFamily = flag.String("ip-family", bridge.IPFamilyIPv4, "IP family registered for dual-stack containers: ipv4, ipv6 or dual (both, the runtime's primary address first)")
 var useIpFromLabel = flag.String("useIpFromLabel", "", "Use IP which is stored in a label assigned to the container")
 var refreshInterval = flag.Int("ttl-refresh", 0, "Frequency with which service TTLs are refreshed")
 var refreshTtl = flag.Int("ttl", 0, "TTL for services (default is no expiry)")
@@ -36,11 +41,54 @@ var deregister = flag.String("deregister", "always", "Deregister exited services
 var retryAttempts = flag.Int("retry-attempts", 0, "Max retry attempts to establish a connection with the backend. Use -1 for infinite retries")
 var retryInterval = flag.Int("retry-interval", 2000, "Interval (in millisecond) between retry-attempts.")
 var cleanup = flag.Bool("cleanup", false, "Remove dangling services")
+var cleanupDryRun = flag.Bool("cleanup-dry-run", false, "Only log the dangling services cleanup would remove")
+var cleanupMax = flag.Int("cleanup-max", 0, "Dangling services removed per cleanup pass, the rest in later passes (unlimited when 0)")
+var cleanupAbort = flag.Int("cleanup-abort", 0, "Percentage of the backend's services above which a cleanup pass removes nothing (disabled when 0)")
+var cleanupProtect = flag.String("cleanup-protect", "", "Regexp of service names and IDs cleanup never removes")
+var cleanupGrace = flag.Int("cleanup-grace", 0, "Time (in seconds) a service has to be dangling in consecutive cleanup passes before it is removed (removed in the first pass when 0)")
 var dataCenterId = flag.String("data-center-id", "", "data center id")
+var logLevel = flag.String("log-level", "info", "Log level: trace, debug, info, warn, error or fatal")
+var logFormat = flag.String("log-format", utils.TextFormat, "Log format: text or json")
+var logEvents = flag.Bool("log-events", false, "Log every containerd event that is not handled otherwise")
+var redactKeys = flag.String("redact-keys", bridge.DefaultRedactKeys, "Regexp of service attr names whose values are masked in logs and admin output")
+var redactValues = flag.String("redact-values", bridge.DefaultRedactValues, "Regexp of secrets masked in logged attr values and tags, only the captured groups are masked if it has any")
+var runtimeSource = flag.String("runtime", "containerd", "Container runtime API: \"containerd\" or \"cri\" (containerd or CRI-O)")
+var namespaceList = flag.String("namespaces", ctrclient.K8sNamespace, "Comma separated containerd namespaces to watch, e.g. \"k8s.io,default\", or \"*\" for all")
+var namespace = flag.String("namespace", "", "Deprecated, use -namespaces")
+var cniResultsDir = flag.String("cni-results-dir", ctrclient.DefaultCNIResultsDir, "CNI result cache the network attachments of containers are read from")
+var criEndpoint = flag.String("cri-endpoint", cri.DefaultEndpoint, "CRI runtime endpoint, e.g. unix:///var/run/crio/crio.sock")
+var criPollInterval = flag.Int("cri-poll-interval", 5, "Interval (in seconds) between container listings when the CRI runtime does not stream events")
+var kubeletURL = flag.String("kubelet-url", "", "Kubelet to read pod readiness from, e.g. "+kubelet.ReadOnlyEndpoint+" or "+kubelet.SecureEndpoint+"; pods are registered when ready (disabled when empty)")
+var kubeletTokenFile = flag.String("kubelet-token-file", "", "Bearer token file for the kubelet, e.g. "+kubelet.DefaultTokenFile)
+var kubeletCAFile = flag.String("kubelet-ca-file", "", "CA certificate file the kubelet serving certificate is verified against")
+var kubeletInsecure = flag.Bool("kubelet-insecure-skip-verify", false, "Do not verify the kubelet serving certificate")
+var kubeletPollInterval = flag.Int("kubelet-poll-interval", 5, "Interval (in seconds) between kubelet pod listings")
+var readinessPolicy = flag.String("readiness-policy", bridge.ReadinessDeregister, "Services of pods that are not ready: \"deregister\" or \"critical\" (maintenance mode, consul only)")
+var warmup = flag.Bool("warmup", false, "Probe services (TCP connect, or GET of SERVICE_CHECK_HTTP) before registering them")
+var warmupTimeout = flag.Int("warmup-timeout", 1000, "Timeout (in milliseconds) of a warm-up probe")
+var warmupInterval = flag.Int("warmup-interval", 1000, "Interval (in milliseconds) between warm-up probes")
+var warmupAttempts = flag.Int("warmup-attempts", 60, "Warm-up probes before a service is not registered")
+var pausePolicy = flag.String("pause-policy", bridge.PauseMaintenance, "Services of paused containers: \"maintenance\" (consul only, deregister otherwise) or \"deregister\"")
+var oomWarning = flag.Int("oom-warning", 300, "Time (in seconds) services report a warning after an OOM kill, where the backend supports it")
+var flapThreshold = flag.Int("flap-threshold", 0, "Starts within -flap-window after which a container is flapping and its services are damped (disabled when 0)")
+var flapWindow = flag.Int("flap-window", 600, "Time (in seconds) starts of a container are counted for flap detection")
+var flapStable = flag.Int("flap-stable", 300, "Time (in seconds) a flapping container has to stay up before its services are restored")
+var flapPolicy = flag.String("flap-policy", bridge.FlapSuppress, "Services of flapping containers: \"suppress\" or \"critical\" (registered with a critical check, consul only)")
+var rateLimit = flag.Float64("rate-limit", 0, "Backend operations per second (unlimited when 0)")
+var rateBurst = flag.Int("rate-burst", 10, "Backend operations allowed in a burst above -rate-limit")
+var breakerFailures = flag.Int("breaker-failures", 5, "Consecutive backend failures that open the circuit breaker; operations are queued while it is open (disabled when 0)")
+var breakerCooldown = flag.Int("breaker-cooldown", 30, "Time (in seconds) the circuit breaker stays open before the backend is probed again")
+var adapterTimeout = flag.Int("adapter-timeout", 10, "Timeout (in seconds) of every backend operation (left to the adapter when 0)")
+var batchSize = flag.Int("batch-size", 100, "Services per batch call of a sync, where the backend supports it (disabled when 1)")
+var batchInterval = flag.Int("batch-interval", 1000, "Time (in milliseconds) after which a partial batch of a sync is sent")
+var heartbeatInterval = flag.Int("heartbeat", 30, "Frequency (in seconds) with which the agent is pinged, where the backend keeps a record of it; an agent the backend lost is registered again with its services (disabled when 0)")
+var instanceId = flag.String("instance-id", "", "ID this registrator stamps its services with, cleanup only removes services of its own ID (default is the hostname)")
+var configFile = flag.String("config", "", "YAML or TOML configuration file, keys are flag names plus \"registry\", flags override it")
+var adminAddr = flag.String("admin-addr", "", "Address of the admin HTTP API and /metrics, e.g. 127.0.0.1:8080 (disabled when empty)")
 
 func assert(err error) {
 	if err != nil {
-		log.Fatal(err)
+		utils.L.Fatal(err)
 	}
 }
 
@@ -49,8 +97,6 @@ func main() {
 		versionChecker.PrintVersion()
 		os.Exit(0)
 	}
-	log.Printf("Starting registrator %s ...", Version)
-
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s [options] <registry URI>\n\n", os.Args[0])
@@ -59,7 +105,21 @@ func main() {
 
 	flag.Parse()
 
-	if flag.NArg() != 1 {
+	var fileConf *fileConfig
+	if *configFile != "" {
+		var err error
+		fileConf, err = newFileConfig(*configFile)
+		assert(err)
+	}
+
+	registryURI := flag.Arg(0)
+	if flag.NArg() == 0 {
+		registryURI = fileConf.registryURI()
+	} else if fileConf != nil {
+		fileConf.explicit[registryKey] = true
+	}
+
+	if flag.NArg() > 1 || registryURI == "" {
 		if flag.NArg() == 0 {
 			fmt.Fprint(os.Stderr, "Missing required argument for registry URI.\n\n")
 		} else {
@@ -71,51 +131,61 @@ func main() {
 		os.Exit(2)
 	}
 
-	if *hostIp != "" {
-		log.Println("Forcing host IP to", *hostIp)
-	}
+	assert(applyLogging())
+	utils.L.WithField("version", Version).Info("starting registrator")
 
-	if (*refreshTtl == 0 && *refreshInterval > 0) || (*refreshTtl > 0 && *refreshInterval == 0) {
-		assert(errors.New("-ttl and -ttl-refresh must be specified together or not at all"))
-	} else if *refreshTtl > 0 && *refreshTtl <= *refreshInterval {
-		assert(errors.New("-ttl must be greater than -ttl-refresh"))
+	if *hostIp != "" {
+		utils.L.WithField("ip", *hostIp).Info("forcing host IP")
 	}
 
-	if *retryInterval <= 0 {
-		assert(errors.New("-retry-interval must be greater than 0"))
-	}
+	assert(applyDeprecatedFlags())
+	assert(validateFlags())
 
-	containerDHost := os.Getenv("CONTAINERD_HOST")
-	if containerDHost == "" {
-		containerDHost = "/run/containerd/containerd.sock"
-		os.Setenv("CONTAINERD_HOST", containerDHost)
-	}
+	// cancelled on shutdown, so that pending backend operations are aborted
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
 
-	ctx := context.Background()
+	var source bridge.ContainerSource
+	switch *runtimeSource {
+	case "containerd":
+		containerDHost := os.Getenv("CONTAINERD_HOST")
+		if containerDHost == "" {
+			containerDHost = "/run/containerd/containerd.sock"
+			os.Setenv("CONTAINERD_HOST", containerDHost)
+		}
 
-	ctrClient, clientCtx, cancel, err := ctrclient.NewCtrClient(ctx, "k8s.io", containerDHost)
-	if err != nil {
+		// the source sets the namespace of every call, the client namespace
+		// only needs to be valid
+		watched := splitList(*namespaceList)
+		clientNamespace := watched[0]
+		if clientNamespace == "*" {
+			clientNamespace = namespaces.Default
+		}
+		ctrClient, clientCtx, clientCancel, err := ctrclient.NewCtrClient(ctx, clientNamespace, containerDHost)
+		assert(err)
+		defer clientCancel()
+
+		ctx = clientCtx
+		containerdSource := bridge.NewContainerdSource(ctrClient, watched)
+		containerdSource.CNIResultsDir = *cniResultsDir
+		source = containerdSource
+	case "cri":
+		criSource, err := cri.NewSource(*criEndpoint, time.Duration(*criPollInterval)*time.Second)
 		assert(err)
+		defer criSource.Close()
+
+		criSource.CNIResultsDir = *cniResultsDir
+		source = criSource
+	default:
+		assert(fmt.Errorf("unknown runtime %q, use containerd or cri", *runtimeSource))
 	}
-	defer cancel()
 
-	b, err := bridge.New(ctrClient, flag.Arg(0), bridge.Config{
-		HostIp:          *hostIp,
-		Internal:        *internal,
-		Explicit:        *explicit,
-		UseIpFromLabel:  *useIpFromLabel,
-		ForceTags:       *forceTags,
-		RefreshTtl:      *refreshTtl,
-		RefreshInterval: *refreshInterval,
-		DeregisterCheck: *deregister,
-		Cleanup:         *cleanup,
-		DataCenterId:    *dataCenterId,
-	}, clientCtx)
+	b, err := bridge.New(source, registryURI, bridgeConfig(), ctx)
 	assert(err)
 
 	attempt := 0
 	for *retryAttempts == -1 || attempt <= *retryAttempts {
-		log.Printf("Connecting to backend (%v/%v)", attempt, *retryAttempts)
+		utils.L.Infof("connecting to backend (%v/%v)", attempt, *retryAttempts)
 
 		err = b.Ping()
 		if err == nil {
@@ -130,11 +200,27 @@ func main() {
 		attempt++
 	}
 
-	// Start event listener before listing containers to avoid missing anything
-	eventService := ctrClient.EventService()
-	eventsCh, errCh := eventService.Subscribe(clientCtx)
-	if err != nil {
+	if *kubeletURL != "" {
+		kubeletClient, err := kubelet.NewClient(*kubeletURL, *kubeletTokenFile, *kubeletCAFile, *kubeletInsecure)
 		assert(err)
+		readiness := kubelet.NewReadiness(kubeletClient)
+		assert(b.SetReadinessGate(readiness, *readinessPolicy))
+		// know the ready pods before the first sync
+		if _, err := readiness.Poll(ctx); err != nil {
+			utils.L.WithError(err).Warn("poll pods failed, registering pods once they are reported ready")
+		}
+		go readiness.Run(ctx, time.Duration(*kubeletPollInterval)*time.Second, b.ReadinessChanged)
+	}
+
+	// Start event listener before listing containers to avoid missing anything
+	eventsCh, errCh := source.Events(ctx)
+
+	if *adminAddr != "" {
+		adminServer := admin.New(b)
+		adminServer.Handle("/metrics", metrics.Handler())
+		go func() {
+			assert(adminServer.ListenAndServe(*adminAddr))
+		}()
 	}
 
 	b.Sync(false)
@@ -142,105 +228,199 @@ func main() {
 	quit := make(chan struct{})
 
 	// Start the TTL refresh timer
-	if *refreshInterval > 0 {
-		ticker := time.NewTicker(time.Duration(*refreshInterval) * time.Second)
-		go func() {
-			for {
-				select {
-				case <-ticker.C:
-					b.Refresh()
-				case <-quit:
-					ticker.Stop()
-					return
-				}
+	ticker := newIntervalTicker(*refreshInterval)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				b.Refresh()
+			case <-quit:
+				ticker.Stop()
+				return
 			}
-		}()
-	}
+		}
+	}()
 
 	// Start the resync timer if enabled
-	if *resyncInterval > 0 {
-		resyncTicker := time.NewTicker(time.Duration(*resyncInterval) * time.Second)
+	resyncTicker := newIntervalTicker(*resyncInterval)
+	go func() {
+		for {
+			select {
+			case <-resyncTicker.C:
+				b.Sync(true)
+			case <-quit:
+				resyncTicker.Stop()
+				return
+			}
+		}
+	}()
+
+	// Start the agent heartbeat
+	heartbeatTicker := newIntervalTicker(*heartbeatInterval)
+	go func() {
+		for {
+			select {
+			case <-heartbeatTicker.C:
+				if err := b.Heartbeat(); err != nil {
+					utils.L.WithError(err).Error("heartbeat failed")
+				}
+			case <-quit:
+				heartbeatTicker.Stop()
+				return
+			}
+		}
+	}()
+
+	// Reload the configuration file on SIGHUP
+	if fileConf != nil {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
 		go func() {
-			for {
-				select {
-				case <-resyncTicker.C:
-					b.Sync(true)
-				case <-quit:
-					resyncTicker.Stop()
-					return
+			for range hup {
+				changed, err := fileConf.reload()
+				if err != nil {
+					utils.L.WithError(err).WithField("file", fileConf.path).Error("configuration reload rejected")
+					continue
+				}
+				if len(changed) == 0 {
+					utils.L.WithField("file", fileConf.path).Info("configuration unchanged")
+					continue
+				}
+				if err := applyLogging(); err != nil {
+					utils.L.WithError(err).Error("apply logging settings failed")
 				}
+				if err := b.SetConfig(bridgeConfig()); err != nil {
+					utils.L.WithError(err).Error("configuration reload rejected")
+					continue
+				}
+				ticker.Set(*refreshInterval)
+				resyncTicker.Set(*resyncInterval)
+				heartbeatTicker.Set(*heartbeatInterval)
+				utils.L.WithField("settings", changed).Info("configuration reloaded")
+				b.Reconcile()
+				b.Sync(true)
 			}
 		}()
 	}
 
-	containerTaskStartHandle := func(eventData typeurl.Any) {
-		containerTaskEvent := events2.TaskStart{}
-		err := typeurl.UnmarshalTo(eventData, &containerTaskEvent)
-
-		if err != nil {
-			fmt.Println("containerTaskStartHandle error", err)
-
-		} else {
-			fmt.Println("task start", containerTaskEvent.ContainerID)
-			b.Add(containerTaskEvent.ContainerID)
-		}
+	containerTaskStartHandle := func(e *bridge.ContainerEvent) {
+		utils.L.WithField("container", e.ContainerID).Info("task start")
+		b.Add(e.ContainerID)
 	}
 
-	containerTaskDeleteHandle := func(eventData typeurl.Any) {
-		containerTaskEvent := events2.TaskDelete{}
-		err := typeurl.UnmarshalTo(eventData, &containerTaskEvent)
-
-		if err != nil {
-			fmt.Println("containerTaskDeleteHandle error", err)
-		} else {
-			fmt.Println("task delete", containerTaskEvent.ContainerID)
-			b.Remove(containerTaskEvent.ContainerID)
-		}
+	containerTaskDeleteHandle := func(e *bridge.ContainerEvent) {
+		utils.L.WithField("container", e.ContainerID).Info("task delete")
+		b.Remove(e.ContainerID)
 	}
 
-	otherEventHandler := func(e *events.Envelope) {
-		v, err := typeurl.UnmarshalAny(e.Event)
+	containerUpdateHandle := func(e *bridge.ContainerEvent) {
+		utils.L.WithField("container", e.ContainerID).Debug("container update")
+		b.Update(e.ContainerID)
+	}
 
-		if err != nil {
-			log.Println("cannot unmarshal an event from Any", err)
-			return
-		}
+	containerPauseHandle := func(e *bridge.ContainerEvent) {
+		b.Pause(e.ContainerID)
+	}
 
-		out, err := json.Marshal(v)
-		if err != nil {
-			log.Println("cannot marshal Any into JSON", err)
-			return
-		}
+	containerResumeHandle := func(e *bridge.ContainerEvent) {
+		b.Resume(e.ContainerID)
+	}
 
-		if _, err := fmt.Println(
-			e.Timestamp,
-			e.Namespace,
-			e.Topic,
-			string(out),
-		); err != nil {
-			fmt.Println(err)
-		}
+	containerOOMHandle := func(e *bridge.ContainerEvent) {
+		b.OOM(e.ContainerID)
 	}
 
+	// The event stream ends after a watch error, it is subscribed to again
+	// with backoff and followed by a sync for the events missed meanwhile.
+	watchBackoff := backoff.NewExponentialBackOff()
+	watchBackoff.MaxElapsedTime = 0
+	var resubscribe <-chan time.Time
+
+EventLoop:
 	for {
-		var e *events.Envelope
+		var e *bridge.ContainerEvent
 		select {
 		case e = <-eventsCh:
+			if e == nil {
+				// closed after a watch error
+				eventsCh = nil
+			}
+		case <-ctx.Done():
+			break EventLoop
 		case err := <-errCh:
-			log.Println("watch event error", err)
+			delay := watchBackoff.NextBackOff()
+			utils.L.WithError(err).WithField("retry", delay).Error("watch event error")
+			eventsCh, errCh = nil, nil
+			resubscribe = time.After(delay)
+		case <-resubscribe:
+			resubscribe = nil
+			utils.L.Info("subscribing to events again")
+			eventsCh, errCh = source.Events(ctx)
+			go b.Sync(true)
 		}
-		if e == nil || e.Event == nil {
+		if e == nil {
 			continue
 		}
-		switch e.Topic {
-		case "/tasks/start":
-			go containerTaskStartHandle(e.Event)
-		case "/tasks/delete":
-			go containerTaskDeleteHandle(e.Event)
+		watchBackoff.Reset()
+		metrics.Events.WithLabelValues(e.Topic).Inc()
+		switch e.Type {
+		case bridge.EventStart:
+			go containerTaskStartHandle(e)
+		case bridge.EventDelete:
+			go containerTaskDeleteHandle(e)
+		case bridge.EventUpdate:
+			go containerUpdateHandle(e)
+		case bridge.EventPause:
+			go containerPauseHandle(e)
+		case bridge.EventResume:
+			go containerResumeHandle(e)
+		case bridge.EventOOM:
+			go containerOOMHandle(e)
 		default:
-			go otherEventHandler(e)
+			go logEvent(e)
 		}
 	}
 	close(quit)
-	log.Fatal("Containerd event loop closed")
+	utils.L.Info("shutting down")
+}
+
+// logEvent logs an event that is not handled otherwise when -log-events is
+// set.
+func logEvent(e *bridge.ContainerEvent) {
+	if !eventLogging.Load() {
+		return
+	}
+	eventLog := utils.L.WithFields(utils.Fields{
+		"namespace": e.Namespace,
+		"topic":     e.Topic,
+		"timestamp": e.Timestamp,
+	})
+
+	out, err := json.Marshal(e.Payload)
+	if err != nil {
+		eventLog.WithError(err).Warn("cannot marshal event into JSON")
+		return
+	}
+
+	eventLog.WithField("event", string(out)).Info("event")
+}
+
+// intervalTicker is a ticker whose interval can be changed while it is in
+// use, a zero interval stops it.
+type intervalTicker struct {
+	*time.Ticker
+}
+
+func newIntervalTicker(seconds int) *intervalTicker {
+	t := &intervalTicker{time.NewTicker(time.Hour)}
+	t.Set(seconds)
+	return t
+}
+
+func (t *intervalTicker) Set(seconds int) {
+	if seconds <= 0 {
+		t.Stop()
+		return
+	}
+	t.Reset(time.Duration(seconds) * time.Second)
 }
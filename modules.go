@@ -3,4 +3,5 @@ package main
 import (
 	_ "registrator-containerd/consul"
 	_ "registrator-containerd/httpcollector"
+	_ "registrator-containerd/webhook"
 )
@@ -18,12 +18,25 @@ func NewCtrClient(ctx context.Context, namespace string, address string, opts ..
 }
 
 const (
+	// K8sNamespace is the containerd namespace of the CRI plugin.
+	K8sNamespace = "k8s.io"
+
 	PodUid        = "io.kubernetes.pod.uid"
 	PodNamespace  = "io.kubernetes.pod.namespace"
 	PodName       = "io.kubernetes.pod.name"
 	ContainerName = "io.kubernetes.container.name"
 
+	ContainerPortsAnnotation = "io.kubernetes.container.ports"
+
 	K8sLabelsContainerMetadata = "io.cri-containerd.container.metadata"
 	K8sLabelsSandboxMetadata   = "io.cri-containerd.sandbox.metadata"
 	ContainerType              = "io.cri-containerd.kind"
+
+	// Labels nerdctl sets on the containers it creates.
+	NerdctlName     = "nerdctl/name"
+	NerdctlHostname = "nerdctl/hostname"
+	NerdctlPorts    = "nerdctl/ports"
+	NerdctlNetworks = "nerdctl/networks"
+	NerdctlIP       = "nerdctl/ip"
+	NerdctlIP6      = "nerdctl/ip6"
 )
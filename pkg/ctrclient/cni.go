@@ -0,0 +1,79 @@
+package ctrclient
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultCNIResultsDir is where libcni caches the result of every network
+// attachment, named <network>-<container id>-<interface>.
+const DefaultCNIResultsDir = "/var/lib/cni/results"
+
+// CNIResult is a network attachment of a container read from the CNI cache.
+type CNIResult struct {
+	Network   string
+	Interface string
+	IPs       []net.IP
+}
+
+type cniCacheEntry struct {
+	ContainerID string `json:"containerId"`
+	IfName      string `json:"ifName"`
+	NetworkName string `json:"networkName"`
+	Result      struct {
+		IPs []struct {
+			Address string `json:"address"`
+		} `json:"ips"`
+	} `json:"result"`
+}
+
+// ReadCNIResults returns the network attachments of a container, sorted by
+// network and interface. The CRI plugin sets up pod networks with the
+// sandbox ID, nerdctl with "<namespace>-<id>" as CNI container id, so both
+// forms match.
+func ReadCNIResults(dir string, containerId string) ([]CNIResult, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*-"+containerId+"-*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var results []CNIResult
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		var entry cniCacheEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			continue
+		}
+		if entry.ContainerID != containerId && !strings.HasSuffix(entry.ContainerID, "-"+containerId) {
+			continue
+		}
+
+		result := CNIResult{Network: entry.NetworkName, Interface: entry.IfName}
+		for _, ip := range entry.Result.IPs {
+			addr, _, err := net.ParseCIDR(ip.Address)
+			if err != nil {
+				continue
+			}
+			result.IPs = append(result.IPs, addr)
+		}
+		results = append(results, result)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Network != results[j].Network {
+			return results[i].Network < results[j].Network
+		}
+		return results[i].Interface < results[j].Interface
+	})
+	return results, nil
+}
@@ -16,8 +16,10 @@ type internalContainerMetadata struct {
 	Name      string
 	SandBoxID string
 	IP        string
-	LogPath   string
-	Config    metadataConfig
+	// AdditionalIPs are the other IPs of a dual-stack sandbox
+	AdditionalIPs []string
+	LogPath       string
+	Config        metadataConfig
 }
 
 type metadataConfig struct {
@@ -25,19 +27,22 @@ type metadataConfig struct {
 	HostName    string
 	Labels      map[string]string
 	Annotations map[string]string
-	Envs        []envMetadata
+	Envs        []EnvMetadata
 }
 
-type envMetadata struct {
+type EnvMetadata struct {
 	Key   string
 	Value string
 }
 
-type portMapping struct {
-	Name          string
-	HostPort      int
-	ContainerPort int
-	Protocol      string
+// PortMapping is a port of the kubelet ports annotation. The nerdctl/ports
+// label decodes into it as well since its keys only differ in case.
+type PortMapping struct {
+	Name          string `json:"name,omitempty"`
+	HostPort      int    `json:"hostPort,omitempty"`
+	HostIP        string `json:"hostIP,omitempty"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
 }
 
 func (m *ContainerMetadata) Unmarshal(metaData typeurl.Any) error {
@@ -48,12 +53,12 @@ func (m *ContainerMetadata) Unmarshal(metaData typeurl.Any) error {
 	return json.Unmarshal(metaData.GetValue(), m)
 }
 
-func (m *ContainerMetadata) GetPortMapping() ([]portMapping, error) {
-	var portMappings []portMapping
+func (m *ContainerMetadata) GetPortMapping() ([]PortMapping, error) {
+	var portMappings []PortMapping
 	if m.Metadata.Config.Annotations == nil {
 		return portMappings, nil
 	}
-	portsJSON := m.Metadata.Config.Annotations["io.kubernetes.container.ports"]
+	portsJSON := m.Metadata.Config.Annotations[ContainerPortsAnnotation]
 	if len(portsJSON) <= 0 {
 		return portMappings, nil
 	}
@@ -63,3 +68,22 @@ func (m *ContainerMetadata) GetPortMapping() ([]portMapping, error) {
 	}
 	return portMappings, nil
 }
+
+// AddEnv appends an environment variable to the container config.
+func (m *ContainerMetadata) AddEnv(key string, value string) {
+	m.Metadata.Config.Envs = append(m.Metadata.Config.Envs, EnvMetadata{Key: key, Value: value})
+}
+
+// SetPortMapping stores the port mappings in the container annotations the
+// way the kubelet does.
+func (m *ContainerMetadata) SetPortMapping(portMappings []PortMapping) error {
+	portsJSON, err := json.Marshal(portMappings)
+	if err != nil {
+		return err
+	}
+	if m.Metadata.Config.Annotations == nil {
+		m.Metadata.Config.Annotations = make(map[string]string)
+	}
+	m.Metadata.Config.Annotations[ContainerPortsAnnotation] = string(portsJSON)
+	return nil
+}
@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+const namespace = "registrator"
+
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+var (
+	// RegistryOperations counts Register/Deregister/Refresh calls per adapter scheme.
+	RegistryOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "registry_operations_total",
+		Help:      "Number of registry adapter operations by scheme, operation and result.",
+	}, []string{"scheme", "operation", "result"})
+
+	// RegistryLatency observes how long the backend takes to answer.
+	RegistryLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "registry_operation_duration_seconds",
+		Help:      "Latency of registry adapter operations by scheme and operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"scheme", "operation"})
+
+	// Events counts received runtime events per topic.
+	Events = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_total",
+		Help:      "Number of runtime events received by topic.",
+	}, []string{"topic"})
+
+	Services = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "services",
+		Help:      "Number of services currently registered by this instance.",
+	})
+
+	DeadContainers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "dead_containers",
+		Help:      "Number of exited containers whose services are kept until their TTL expires.",
+	})
+
+	FlappingContainers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "flapping_containers",
+		Help:      "Number of containers whose services are damped because they restart too often.",
+	})
+
+	// FlapDamped counts the services of flapping containers by flap policy.
+	FlapDamped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "flap_damped_services_total",
+		Help:      "Number of services of flapping containers suppressed or registered critical, by policy.",
+	}, []string{"policy"})
+
+	// BreakerState is 1 for the current state of the circuit breaker of an
+	// adapter scheme and 0 for the others.
+	BreakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "breaker_state",
+		Help:      "State of the circuit breaker in front of the backend by scheme and state.",
+	}, []string{"scheme", "state"})
+
+	QueuedOperations = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queued_operations",
+		Help:      "Number of registry adapter operations queued while the circuit breaker is open, by scheme.",
+	}, []string{"scheme"})
+
+	AgentReregistrations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "agent_reregistrations_total",
+		Help:      "Number of times the agent was registered again because the backend no longer knew it, by scheme.",
+	}, []string{"scheme"})
+
+	// CleanupServices counts the dangling services found by cleanup by
+	// what was done with them.
+	CleanupServices = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cleanup_services_total",
+		Help:      "Number of dangling services found by cleanup, by action: removed, dry_run, protected, deferred, limited or aborted.",
+	}, []string{"action"})
+
+	SyncDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "sync_duration_seconds",
+		Help:      "Duration of full synchronisations.",
+		Buckets:   []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	})
+
+	LastSync = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_sync_timestamp_seconds",
+		Help:      "Unix timestamp of the last successful synchronisation.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		RegistryOperations,
+		RegistryLatency,
+		Events,
+		Services,
+		DeadContainers,
+		FlappingContainers,
+		FlapDamped,
+		BreakerState,
+		QueuedOperations,
+		AgentReregistrations,
+		CleanupServices,
+		SyncDuration,
+		LastSync,
+	)
+}
+
+// ObserveRegistry records the result and latency of one registry operation
+// started at start.
+func ObserveRegistry(scheme string, operation string, start time.Time, err error) {
+	RegistryLatency.WithLabelValues(scheme, operation).Observe(time.Since(start).Seconds())
+	result := ResultSuccess
+	if err != nil {
+		result = ResultFailure
+	}
+	RegistryOperations.WithLabelValues(scheme, operation, result).Inc()
+}
+
+// ObserveSync records a completed synchronisation started at start.
+func ObserveSync(start time.Time) {
+	SyncDuration.Observe(time.Since(start).Seconds())
+	LastSync.Set(float64(time.Now().Unix()))
+}
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -2,7 +2,9 @@ package utils
 
 import (
 	"context"
+	"fmt"
 	"github.com/sirupsen/logrus"
+	"time"
 )
 
 var G = GetLogger
@@ -18,9 +20,53 @@ var L = &Entry{
 type Fields = map[string]any
 type loggerKey struct{}
 
+const (
+	// RFC3339NanoFixed is time.RFC3339Nano with nanoseconds padded using
+	// zeros to ensure the formatted time is always the same number of
+	// characters.
+	RFC3339NanoFixed = "2006-01-02T15:04:05.000000000Z07:00"
+
+	TextFormat = "text"
+	JSONFormat = "json"
+)
+
+// WithLogger returns a new context with the provided logger. Use in
+// combination with logger.WithField(s) for great effect.
+func WithLogger(ctx context.Context, logger *Entry) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger.WithContext(ctx))
+}
+
 func GetLogger(ctx context.Context) *Entry {
 	if logger := ctx.Value(loggerKey{}); logger != nil {
 		return logger.(*Entry)
 	}
 	return L.WithContext(ctx)
 }
+
+// SetLevel sets the level of the standard logger, e.g. "debug" or "warn".
+func SetLevel(level string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	L.Logger.SetLevel(lvl)
+	return nil
+}
+
+// SetFormat sets the output format of the standard logger, "text" or "json".
+func SetFormat(format string) error {
+	switch format {
+	case TextFormat:
+		L.Logger.SetFormatter(&logrus.TextFormatter{
+			TimestampFormat: RFC3339NanoFixed,
+			FullTimestamp:   true,
+		})
+	case JSONFormat:
+		L.Logger.SetFormatter(&logrus.JSONFormatter{
+			TimestampFormat: time.RFC3339Nano,
+		})
+	default:
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"registrator-containerd/bridge"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the YAML file of a webhook:// adapter. Every operation is an
+// HTTP request, register and deregister are required. Update falls back to
+// register, the other operations are skipped when they are not configured.
+type Config struct {
+	// BaseURL is prepended to URLs without a scheme
+	BaseURL string `yaml:"base_url"`
+	// Headers are sent with every request, operations can override them
+	Headers map[string]string `yaml:"headers"`
+	// CAFile is the CA bundle https servers are verified against, the
+	// system roots when empty
+	CAFile string `yaml:"ca_file"`
+
+	RegisterAgent *Operation `yaml:"register_agent"`
+	Ping          *Operation `yaml:"ping"`
+	Register      *Operation `yaml:"register"`
+	Update        *Operation `yaml:"update"`
+	Deregister    *Operation `yaml:"deregister"`
+	Refresh       *Operation `yaml:"refresh"`
+	Services      *Operation `yaml:"services"`
+}
+
+// Operation is a request. URL, Headers and Body are templates executed with
+// Data.
+type Operation struct {
+	Method  string            `yaml:"method"`
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
+	Success Condition         `yaml:"success"`
+	// UnknownAgent is the response of ping for an agent the registry has
+	// no record of
+	UnknownAgent *Condition `yaml:"unknown_agent"`
+	// ID is the JSON path of the agent ID in the response of register_agent
+	ID string `yaml:"id"`
+	// Items is the JSON path of the list of services in the response of
+	// services, Fields the JSON paths of the service fields within an item
+	// by field: id, name, port, ip, ips, tags, attrs, ttl and agent_id.
+	Items  string            `yaml:"items"`
+	Fields map[string]string `yaml:"fields"`
+}
+
+// Condition matches a response. It matches when the status is one of
+// Status, any 2xx status when empty, and the JSON value at Path is Value.
+type Condition struct {
+	Status []int  `yaml:"status"`
+	Path   string `yaml:"path"`
+	Value  string `yaml:"value"`
+}
+
+// Data is what the templates of an operation are executed with.
+type Data struct {
+	Service *bridge.Service
+	Agent   bridge.Agent
+	AgentId string
+}
+
+// defaultFields are the JSON keys of a bridge.Service, so that a registry
+// storing the body {{ json .Service }} needs no field paths.
+var defaultFields = map[string]string{
+	"id":       "ID",
+	"name":     "Name",
+	"port":     "Port",
+	"ip":       "IP",
+	"ips":      "IPs",
+	"tags":     "Tags",
+	"attrs":    "Attrs",
+	"ttl":      "TTL",
+	"agent_id": "AgentId",
+}
+
+var funcs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"env":  os.Getenv,
+	"join": strings.Join,
+}
+
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := new(Config)
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if config.Register == nil || config.Deregister == nil {
+		return nil, fmt.Errorf("%s: register and deregister are required", path)
+	}
+	return config, nil
+}
+
+// operation is a compiled Operation.
+type operation struct {
+	*Operation
+	name    string
+	url     *template.Template
+	headers map[string]*template.Template
+	body    *template.Template
+	fields  map[string]string
+}
+
+func compile(name string, op *Operation, headers map[string]string) (*operation, error) {
+	if op == nil {
+		return nil, nil
+	}
+	if op.URL == "" {
+		return nil, fmt.Errorf("%s: url is required", name)
+	}
+	compiled := &operation{Operation: op, name: name, headers: make(map[string]*template.Template)}
+	if compiled.Method == "" {
+		compiled.Method = "POST"
+		if op.Body == "" {
+			compiled.Method = "GET"
+		}
+	}
+	var err error
+	if compiled.url, err = template.New(name + " url").Funcs(funcs).Parse(op.URL); err != nil {
+		return nil, err
+	}
+	if op.Body != "" {
+		if compiled.body, err = template.New(name + " body").Funcs(funcs).Parse(op.Body); err != nil {
+			return nil, err
+		}
+	}
+	merged := make(map[string]string)
+	for key, value := range headers {
+		merged[key] = value
+	}
+	for key, value := range op.Headers {
+		merged[key] = value
+	}
+	for key, value := range merged {
+		if compiled.headers[key], err = template.New(name + " header " + key).Funcs(funcs).Parse(value); err != nil {
+			return nil, err
+		}
+	}
+	compiled.fields = make(map[string]string)
+	for field, path := range defaultFields {
+		compiled.fields[field] = path
+	}
+	for field, path := range op.Fields {
+		if _, ok := defaultFields[field]; !ok {
+			return nil, fmt.Errorf("%s: unknown field %q", name, field)
+		}
+		compiled.fields[field] = path
+	}
+	return compiled, nil
+}
+
+func execute(t *template.Template, data Data) (string, error) {
+	var out bytes.Buffer
+	if err := t.Execute(&out, data); err != nil {
+		// the service cannot be sent, the backend is not at fault
+		return "", fmt.Errorf("%w: %w", bridge.ErrRejected, err)
+	}
+	return out.String(), nil
+}
+
+// matches reports whether a response with the status and the parsed JSON
+// body satisfies the condition.
+func (c *Condition) matches(status int, body interface{}) bool {
+	if !c.statusMatches(status) {
+		return false
+	}
+	if c.Path == "" {
+		return true
+	}
+	value, ok := lookup(body, c.Path)
+	return ok && fmt.Sprint(value) == c.Value
+}
+
+func (c *Condition) statusMatches(status int) bool {
+	if len(c.Status) == 0 {
+		return status >= 200 && status <= 299
+	}
+	for _, s := range c.Status {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the value at a dotted JSON path, e.g. "data.items" or
+// "data.0.id". Keys match case-insensitively when there is no exact match,
+// like encoding/json. The empty path is the value itself.
+func lookup(value interface{}, path string) (interface{}, bool) {
+	if path == "" {
+		return value, true
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			next, ok := v[key]
+			if !ok {
+				for k, n := range v {
+					if strings.EqualFold(k, key) {
+						next, ok = n, true
+						break
+					}
+				}
+			}
+			if !ok {
+				return nil, false
+			}
+			value = next
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
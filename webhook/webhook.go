@@ -0,0 +1,323 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"registrator-containerd/bridge"
+	"registrator-containerd/utils"
+	"strconv"
+	"strings"
+)
+
+var logger = utils.L.WithField("adapter", "webhook")
+
+func init() {
+	bridge.Register(new(Factory), "webhook")
+}
+
+type Factory struct{}
+
+func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
+	return bridge.AdapterV1(f.NewV2(uri))
+}
+
+// NewV2 reads the configuration file of the URI, e.g.
+// webhook:///etc/registrator/webhook.yaml.
+func (f *Factory) NewV2(uri *url.URL) bridge.RegistryAdapterV2 {
+	path := uri.Host + uri.Path
+	adapter, err := newAdapter(path)
+	if err != nil {
+		logger.WithError(err).WithField("file", path).Fatal("cannot create webhook adapter")
+	}
+	return adapter
+}
+
+// WebhookAdapter registers services with any HTTP API, the requests and the
+// interpretation of the responses are described by a Config.
+type WebhookAdapter struct {
+	client  *http.Client
+	baseUrl string
+
+	registerAgent *operation
+	ping          *operation
+	register      *operation
+	update        *operation
+	deregister    *operation
+	refresh       *operation
+	services      *operation
+}
+
+func newAdapter(path string) (*WebhookAdapter, error) {
+	config, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.CAFile != "" {
+		ca, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate in %s", config.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: roots}
+	}
+	w := &WebhookAdapter{
+		client:  &http.Client{Transport: transport},
+		baseUrl: strings.TrimSuffix(config.BaseURL, "/"),
+	}
+
+	for _, op := range []struct {
+		name   string
+		config *Operation
+		target **operation
+	}{
+		{"register_agent", config.RegisterAgent, &w.registerAgent},
+		{"ping", config.Ping, &w.ping},
+		{"register", config.Register, &w.register},
+		{"update", config.Update, &w.update},
+		{"deregister", config.Deregister, &w.deregister},
+		{"refresh", config.Refresh, &w.refresh},
+		{"services", config.Services, &w.services},
+	} {
+		if *op.target, err = compile(op.name, op.config, config.Headers); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if w.update == nil {
+		w.update = w.register
+	}
+	return w, nil
+}
+
+// Capabilities: services expire when a refresh is configured, the registry
+// keeps a record of the agent when register_agent is configured.
+func (w *WebhookAdapter) Capabilities() bridge.Capabilities {
+	return bridge.Capabilities{TTL: w.refresh != nil, Agent: w.registerAgent != nil}
+}
+
+// call sends the request of an operation and returns the parsed JSON body
+// of the response, nil when it is not JSON. Templates that fail and
+// responses that do not match success below 500 reject the operation.
+func (w *WebhookAdapter) call(ctx context.Context, op *operation, data Data) (interface{}, error) {
+	target, err := execute(op.url, data)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(target, "://") {
+		target = w.baseUrl + target
+	}
+	var body io.Reader
+	if op.body != nil {
+		content, err := execute(op.body, data)
+		if err != nil {
+			return nil, err
+		}
+		body = strings.NewReader(content)
+	}
+	request, err := http.NewRequestWithContext(ctx, op.Method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	for key, header := range op.headers {
+		value, err := execute(header, data)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set(key, value)
+	}
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	content, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed interface{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	if decoder.Decode(&parsed) != nil {
+		parsed = nil
+	}
+	if op.UnknownAgent != nil && op.UnknownAgent.matches(response.StatusCode, parsed) {
+		return parsed, bridge.ErrUnknownAgent
+	}
+	if !op.Success.matches(response.StatusCode, parsed) {
+		// the body is left out, it may echo the payload
+		err := fmt.Errorf("%s response status %s", op.name, response.Status)
+		if response.StatusCode < 500 {
+			err = fmt.Errorf("%w: %w", bridge.ErrRejected, err)
+		}
+		return parsed, err
+	}
+	return parsed, nil
+}
+
+func (w *WebhookAdapter) RegisterAgentNode(ctx context.Context, agent bridge.Agent) (string, error) {
+	if w.registerAgent == nil {
+		return "", nil
+	}
+	logger.WithField("hostname", agent.Hostname).Info("register agent node")
+	parsed, err := w.call(ctx, w.registerAgent, Data{Agent: agent})
+	if err != nil {
+		return "", err
+	}
+	if w.registerAgent.ID == "" {
+		return "", nil
+	}
+	id, ok := lookup(parsed, w.registerAgent.ID)
+	if !ok {
+		return "", fmt.Errorf("register_agent response has no %s", w.registerAgent.ID)
+	}
+	return fmt.Sprint(id), nil
+}
+
+func (w *WebhookAdapter) Ping(ctx context.Context, agentId string) error {
+	if w.ping == nil {
+		return nil
+	}
+	_, err := w.call(ctx, w.ping, Data{AgentId: agentId})
+	return err
+}
+
+func (w *WebhookAdapter) Register(ctx context.Context, service *bridge.Service) error {
+	logger.WithField("service", service.ID).WithField("payload", service.RedactedJSON()).Debug("register")
+	_, err := w.call(ctx, w.register, Data{Service: service, AgentId: service.AgentId})
+	return err
+}
+
+func (w *WebhookAdapter) Update(ctx context.Context, service *bridge.Service) error {
+	logger.WithField("service", service.ID).WithField("payload", service.RedactedJSON()).Debug("update")
+	_, err := w.call(ctx, w.update, Data{Service: service, AgentId: service.AgentId})
+	return err
+}
+
+func (w *WebhookAdapter) Deregister(ctx context.Context, service *bridge.Service) error {
+	logger.WithField("service", service.ID).WithField("payload", service.RedactedJSON()).Debug("deregister")
+	_, err := w.call(ctx, w.deregister, Data{Service: service, AgentId: service.AgentId})
+	return err
+}
+
+func (w *WebhookAdapter) Refresh(ctx context.Context, service *bridge.Service) error {
+	if w.refresh == nil {
+		return nil
+	}
+	_, err := w.call(ctx, w.refresh, Data{Service: service, AgentId: service.AgentId})
+	return err
+}
+
+// Services lists the services at the items path of the response, nothing
+// when services is not configured.
+func (w *WebhookAdapter) Services(ctx context.Context, agentId string) ([]*bridge.Service, error) {
+	if w.services == nil {
+		return nil, nil
+	}
+	parsed, err := w.call(ctx, w.services, Data{AgentId: agentId})
+	if err != nil {
+		return nil, err
+	}
+	list, ok := lookup(parsed, w.services.Items)
+	if !ok {
+		return nil, fmt.Errorf("services response has no %s", w.services.Items)
+	}
+	items, ok := list.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("services response %s is not a list", w.services.Items)
+	}
+	out := make([]*bridge.Service, 0, len(items))
+	for _, item := range items {
+		service, err := w.service(item)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, service)
+	}
+	return out, nil
+}
+
+// service reads a service from an item of the services response.
+func (w *WebhookAdapter) service(item interface{}) (*bridge.Service, error) {
+	field := func(name string) interface{} {
+		value, _ := lookup(item, w.services.fields[name])
+		return value
+	}
+	port, err := toInt(field("port"))
+	if err != nil {
+		return nil, fmt.Errorf("services: port: %w", err)
+	}
+	ttl, err := toInt(field("ttl"))
+	if err != nil {
+		return nil, fmt.Errorf("services: ttl: %w", err)
+	}
+	service := &bridge.Service{
+		ID:      toString(field("id")),
+		Name:    toString(field("name")),
+		Port:    port,
+		IP:      toString(field("ip")),
+		IPs:     toStrings(field("ips")),
+		Tags:    toStrings(field("tags")),
+		TTL:     ttl,
+		AgentId: toString(field("agent_id")),
+	}
+	if service.ID == "" {
+		return nil, fmt.Errorf("services: item without %s", w.services.fields["id"])
+	}
+	if attrs, ok := field("attrs").(map[string]interface{}); ok {
+		service.Attrs = make(map[string]string, len(attrs))
+		for key, value := range attrs {
+			service.Attrs[key] = toString(value)
+		}
+	}
+	return service, nil
+}
+
+func toString(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+func toStrings(value interface{}) []string {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil
+	}
+	out := make([]string, len(list))
+	for i, v := range list {
+		out[i] = toString(v)
+	}
+	return out
+}
+
+func toInt(value interface{}) (int, error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case json.Number:
+		i, err := v.Int64()
+		return int(i), err
+	case string:
+		return strconv.Atoi(v)
+	default:
+		return 0, fmt.Errorf("%v is not a number", value)
+	}
+}
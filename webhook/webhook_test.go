@@ -0,0 +1,270 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"registrator-containerd/bridge"
+	"strings"
+	"testing"
+)
+
+func newTestAdapter(t *testing.T, handler http.HandlerFunc) *WebhookAdapter {
+	t.Helper()
+	return newConfigAdapter(t, handler, "register:\n  url: /services\n  body: '{{ json .Service }}'\n"+
+		"deregister:\n  method: DELETE\n  url: /services/{{ .Service.ID }}\n")
+}
+
+// newConfigAdapter returns an adapter with the operations of config, sending
+// its requests to handler.
+func newConfigAdapter(t *testing.T, handler http.HandlerFunc, config string) *WebhookAdapter {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	path := filepath.Join(t.TempDir(), "webhook.yaml")
+	config = "base_url: " + server.URL + "\n" + config
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	adapter, err := newAdapter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return adapter
+}
+
+func TestErrorsLeaveTheResponseBodyOut(t *testing.T) {
+	// the registry echoes the payload it refuses
+	adapter := newTestAdapter(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(body)
+	})
+	service := &bridge.Service{ID: "web", Name: "web", Attrs: map[string]string{"check_http": "http://app/health?token=hunter2"}}
+
+	err := adapter.Register(context.Background(), service)
+	if !errors.Is(err, bridge.ErrRejected) {
+		t.Fatalf("err = %v, want ErrRejected", err)
+	}
+	if strings.Contains(err.Error(), "hunter2") {
+		t.Fatalf("err = %q, leaks the payload", err)
+	}
+}
+
+func TestServerErrorsAreNotRejections(t *testing.T) {
+	adapter := newTestAdapter(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	err := adapter.Deregister(context.Background(), &bridge.Service{ID: "web"})
+	if err == nil || errors.Is(err, bridge.ErrRejected) {
+		t.Fatalf("err = %v, want a failure that is not ErrRejected", err)
+	}
+}
+
+// request is what a test server received.
+type request struct {
+	method  string
+	path    string
+	header  http.Header
+	content string
+}
+
+// recorder answers with status and body and sends the requests it receives
+// to the returned channel.
+func recorder(status int, body string) (http.HandlerFunc, chan request) {
+	requests := make(chan request, 10)
+	return func(w http.ResponseWriter, r *http.Request) {
+		content, _ := io.ReadAll(r.Body)
+		requests <- request{method: r.Method, path: r.URL.Path, header: r.Header, content: string(content)}
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}, requests
+}
+
+func TestTemplatesRenderTheRequest(t *testing.T) {
+	t.Setenv("WEBHOOK_TEST_TOKEN", "secret")
+	handler, requests := recorder(http.StatusOK, "")
+	adapter := newConfigAdapter(t, handler, `headers:
+  Authorization: 'Bearer {{ env "WEBHOOK_TEST_TOKEN" }}'
+register:
+  method: PUT
+  url: /agents/{{ .AgentId }}/services/{{ .Service.ID }}
+  headers:
+    X-Service: '{{ .Service.Name }}'
+  body: '{"name": {{ json .Service.Name }}, "tags": "{{ join .Service.Tags "," }}"}'
+deregister:
+  url: /services/{{ .Service.ID }}
+`)
+	service := &bridge.Service{ID: "web-1", Name: "web", Tags: []string{"a", "b"}, AgentId: "agent-1"}
+
+	if err := adapter.Register(context.Background(), service); err != nil {
+		t.Fatal(err)
+	}
+	got := <-requests
+	if got.method != http.MethodPut || got.path != "/agents/agent-1/services/web-1" {
+		t.Fatalf("request = %s %s", got.method, got.path)
+	}
+	if got.content != `{"name": "web", "tags": "a,b"}` {
+		t.Fatalf("body = %s", got.content)
+	}
+	for key, want := range map[string]string{"Authorization": "Bearer secret", "X-Service": "web", "Content-Type": "application/json"} {
+		if value := got.header.Get(key); value != want {
+			t.Fatalf("%s = %q, want %q", key, value, want)
+		}
+	}
+
+	// without a body the method defaults to GET
+	if err := adapter.Deregister(context.Background(), service); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-requests; got.method != http.MethodGet || got.path != "/services/web-1" {
+		t.Fatalf("request = %s %s", got.method, got.path)
+	}
+}
+
+func TestSuccessConditionMatchesTheStatusAndValue(t *testing.T) {
+	config := `register:
+  url: /services
+  body: '{{ json .Service }}'
+  success:
+    status: [200]
+    path: result.code
+    value: ok
+deregister:
+  url: /services/{{ .Service.ID }}
+`
+	service := &bridge.Service{ID: "web"}
+	for _, test := range []struct {
+		status   int
+		body     string
+		rejected bool
+	}{
+		{http.StatusOK, `{"result": {"code": "ok"}}`, false},
+		{http.StatusOK, `{"Result": {"Code": "ok"}}`, false},
+		{http.StatusOK, `{"result": {"code": "duplicate"}}`, true},
+		{http.StatusOK, `not json`, true},
+		{http.StatusCreated, `{"result": {"code": "ok"}}`, true},
+	} {
+		handler, _ := recorder(test.status, test.body)
+		adapter := newConfigAdapter(t, handler, config)
+
+		err := adapter.Register(context.Background(), service)
+		if test.rejected && !errors.Is(err, bridge.ErrRejected) || !test.rejected && err != nil {
+			t.Fatalf("%d %s: err = %v", test.status, test.body, err)
+		}
+	}
+}
+
+func TestPingMapsUnknownAgent(t *testing.T) {
+	config := `register_agent:
+  url: /agents
+  body: '{{ json .Agent }}'
+  id: data.id
+ping:
+  url: /agents/{{ .AgentId }}
+  unknown_agent:
+    status: [404]
+register:
+  url: /services
+  body: '{{ json .Service }}'
+deregister:
+  url: /services/{{ .Service.ID }}
+`
+	handler, requests := recorder(http.StatusOK, `{"data": {"id": 7}}`)
+	adapter := newConfigAdapter(t, handler, config)
+	if caps := adapter.Capabilities(); !caps.Agent || caps.TTL {
+		t.Fatalf("capabilities = %+v", caps)
+	}
+	agentId, err := adapter.RegisterAgentNode(context.Background(), bridge.Agent{Hostname: "node-1"})
+	if err != nil || agentId != "7" {
+		t.Fatalf("agent id = %q, err = %v", agentId, err)
+	}
+	if got := <-requests; got.method != http.MethodPost || !strings.Contains(got.content, `"node-1"`) {
+		t.Fatalf("request = %s %s", got.method, got.content)
+	}
+	if err := adapter.Ping(context.Background(), agentId); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-requests; got.path != "/agents/7" {
+		t.Fatalf("ping path = %s", got.path)
+	}
+
+	handler, _ = recorder(http.StatusNotFound, "")
+	adapter = newConfigAdapter(t, handler, config)
+	if err := adapter.Ping(context.Background(), "7"); !errors.Is(err, bridge.ErrUnknownAgent) {
+		t.Fatalf("err = %v, want ErrUnknownAgent", err)
+	}
+}
+
+func TestServicesParsesTheItems(t *testing.T) {
+	config := `register:
+  url: /services
+  body: '{{ json .Service }}'
+deregister:
+  url: /services/{{ .Service.ID }}
+services:
+  url: /agents/{{ .AgentId }}/services
+  items: data.services
+  fields:
+    id: key
+    port: address.port
+    ip: address.ip
+    attrs: meta
+`
+	handler, requests := recorder(http.StatusOK, `{"data": {"services": [
+		{"key": "web-1", "name": "web", "address": {"ip": "10.0.0.2", "port": "8080"},
+		 "ips": ["10.0.0.2", "fd00::2"], "tags": ["a", 1], "meta": {"zone": "a", "weight": 10},
+		 "ttl": 30, "agentId": "agent-1"},
+		{"key": "db-1", "address": {"port": 5432}}
+	]}}`)
+	adapter := newConfigAdapter(t, handler, config)
+
+	services, err := adapter.Services(context.Background(), "agent-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-requests; got.path != "/agents/agent-1/services" {
+		t.Fatalf("path = %s", got.path)
+	}
+	want := []*bridge.Service{
+		{
+			ID:      "web-1",
+			Name:    "web",
+			Port:    8080,
+			IP:      "10.0.0.2",
+			IPs:     []string{"10.0.0.2", "fd00::2"},
+			Tags:    []string{"a", "1"},
+			Attrs:   map[string]string{"zone": "a", "weight": "10"},
+			TTL:     30,
+			AgentId: "agent-1",
+		},
+		{ID: "db-1", Port: 5432},
+	}
+	if len(services) != len(want) {
+		t.Fatalf("services = %d, want %d", len(services), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(services[i], want[i]) {
+			t.Fatalf("service = %+v, want %+v", services[i], want[i])
+		}
+	}
+
+	for body, want := range map[string]string{
+		`{"data": {}}`:                              "has no data.services",
+		`{"data": {"services": {}}}`:                "is not a list",
+		`{"data": {"services": [{"name": "web"}]}}`: "item without key",
+		`{"data": {"services": [{"key": "web", "address": {"port": true}}]}}`: "port",
+	} {
+		handler, _ := recorder(http.StatusOK, body)
+		adapter := newConfigAdapter(t, handler, config)
+		if _, err := adapter.Services(context.Background(), "agent-1"); err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("%s: err = %v, want %q", body, err, want)
+		}
+	}
+}